@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+const amqpTarget = "amqp"
+
+//AMQPTarget publishes a message to an AMQP (RabbitMQ) exchange on each trigger
+type AMQPTarget struct {
+	URL string `json:"url" bson:"url"`
+	//Exchange empty means the default exchange, where the routing key is the queue name
+	Exchange string `json:"exchange,omitempty" bson:"exchange,omitempty"`
+	//RoutingKey Go template with the same values as webhook bodies
+	RoutingKey string            `json:"routingKey" bson:"routingKey"`
+	Headers    map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+	Persistent bool              `json:"persistent,omitempty" bson:"persistent,omitempty"`
+	//ReplyTimeoutSeconds if positive, waits for a reply (request-reply), which becomes the run output
+	ReplyTimeoutSeconds int `json:"replyTimeoutSeconds,omitempty" bson:"replyTimeoutSeconds,omitempty"`
+	TimeoutSeconds      int `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+}
+
+//amqpMessage a message to be published
+type amqpMessage struct {
+	Exchange   string
+	RoutingKey string
+	//ID message and correlation id. Replies are matched by it
+	ID      string
+	Headers map[string]string
+	Body    []byte
+}
+
+//amqpPublisher publishes messages, returning after they were confirmed by the broker and, if
+//the target waits for replies, with the reply
+type amqpPublisher interface {
+	Publish(target *AMQPTarget, message amqpMessage) ([]byte, error)
+}
+
+var (
+	amqpPublisherInstance amqpPublisher = newAMQPConnPublisher()
+)
+
+//amqpExecutor publishes messages to AMQP brokers with publisher confirms. Runs finish synchronously
+type amqpExecutor struct{}
+
+func (e amqpExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.AMQP
+	if target == nil || target.URL == "" {
+		return errors.New("'target.amqp.url' is required")
+	}
+	if target.RoutingKey == "" && target.Exchange == "" {
+		return errors.New("'target.amqp.routingKey' or 'target.amqp.exchange' is required")
+	}
+	if _, err := parseTemplate("routingKey", target.RoutingKey); err != nil {
+		return fmt.Errorf("'target.amqp.routingKey' is not a valid template. err=%s", err)
+	}
+	if target.ReplyTimeoutSeconds < 0 || target.TimeoutSeconds < 0 {
+		return errors.New("'target.amqp' timeouts must be positive")
+	}
+	if target.TimeoutSeconds == 0 {
+		target.TimeoutSeconds = 10
+	}
+	return nil
+}
+
+func (e amqpExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.AMQP
+	run := Run{WorkflowID: newRunID()}
+
+	data := newTemplateData(schedule, trigger)
+	data.Input = input
+	routingKey, err := renderTemplate("routingKey", target.RoutingKey, data)
+	if err != nil {
+		return Run{}, nil, fmt.Errorf("Couldn't render routing key. err=%s", err)
+	}
+	body, err := json.Marshal(messagePayload(trigger, input, run.WorkflowID))
+	if err != nil {
+		return Run{}, nil, err
+	}
+	headers := map[string]string{"schellar-schedule": schedule.Name}
+	for k, v := range target.Headers {
+		headers[k] = v
+	}
+	run.Result = map[string]interface{}{"exchange": target.Exchange, "routingKey": routingKey}
+
+	startTime := time.Now()
+	reply, err := amqpPublisherInstance.Publish(target, amqpMessage{
+		Exchange:   target.Exchange,
+		RoutingKey: routingKey,
+		ID:         run.WorkflowID,
+		Headers:    headers,
+		Body:       body,
+	})
+	if err != nil {
+		logrus.Infof("Schedule %s: Couldn't publish to AMQP exchange '%s' with routing key '%s'. err=%s", schedule.Name, target.Exchange, routingKey, err)
+	} else {
+		logrus.Infof("Schedule %s: Message published to AMQP exchange '%s' with routing key '%s'. runId=%s", schedule.Name, target.Exchange, routingKey, run.WorkflowID)
+	}
+	return run, messageRunState(&run, startTime, reply, err), nil
+}
+
+func (e amqpExecutor) Status(run Run) (*Workflow, error) {
+	return lostRunState(run), nil
+}
+
+func (e amqpExecutor) Cancel(run Run, reason string) error {
+	return fmt.Errorf("AMQP messages can't be cancelled")
+}
+
+//amqpConnPublisher publishes with amqp091-go, keeping one connection per broker URL. Each message
+//uses its own channel
+type amqpConnPublisher struct {
+	mutex sync.Mutex
+	conns map[string]*amqp.Connection
+}
+
+func newAMQPConnPublisher() *amqpConnPublisher {
+	return &amqpConnPublisher{conns: make(map[string]*amqp.Connection)}
+}
+
+//connection returns the connection to the broker of the target, connecting again if it was closed
+func (p *amqpConnPublisher) connection(target *AMQPTarget, timeout time.Duration) (*amqp.Connection, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conn, exists := p.conns[target.URL]
+	if exists && !conn.IsClosed() {
+		return conn, nil
+	}
+	conn, err := amqp.DialConfig(target.URL, amqp.Config{Dial: amqp.DefaultDial(timeout)})
+	if err != nil {
+		return nil, err
+	}
+	p.conns[target.URL] = conn
+	return conn, nil
+}
+
+//Publish publishes the message and waits for the broker confirmation and, if configured, for the reply
+func (p *amqpConnPublisher) Publish(target *AMQPTarget, message amqpMessage) ([]byte, error) {
+	timeout := time.Duration(target.TimeoutSeconds) * time.Second
+	conn, err := p.connection(target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+	err = ch.Confirm(false)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := amqp.Table{}
+	for k, v := range message.Headers {
+		headers[k] = v
+	}
+	msg := amqp.Publishing{
+		ContentType:   "application/json",
+		MessageId:     message.ID,
+		CorrelationId: message.ID,
+		Timestamp:     time.Now(),
+		Headers:       headers,
+		Body:          message.Body,
+	}
+	if target.Persistent {
+		msg.DeliveryMode = amqp.Persistent
+	}
+
+	var replies <-chan amqp.Delivery
+	if target.ReplyTimeoutSeconds > 0 {
+		queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't declare reply queue. err=%s", err)
+		}
+		replies, err = ch.Consume(queue.Name, "", true, true, false, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't consume reply queue. err=%s", err)
+		}
+		msg.ReplyTo = queue.Name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, message.Exchange, message.RoutingKey, false, false, msg)
+	if err != nil {
+		return nil, err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Broker didn't confirm the message. err=%s", err)
+	}
+	if !acked {
+		return nil, errors.New("Broker rejected the message")
+	}
+	if replies == nil {
+		return nil, nil
+	}
+
+	replyTimeout := time.After(time.Duration(target.ReplyTimeoutSeconds) * time.Second)
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return nil, errors.New("Connection closed while waiting for reply")
+			}
+			if reply.CorrelationId == message.ID {
+				return reply.Body, nil
+			}
+		case <-replyTimeout:
+			return nil, fmt.Errorf("No reply after %d seconds", target.ReplyTimeoutSeconds)
+		}
+	}
+}
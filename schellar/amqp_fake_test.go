@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+//fakeAMQPPublisher in-memory broker that keeps published messages and answers them with reply
+type fakeAMQPPublisher struct {
+	mutex    sync.Mutex
+	messages []amqpMessage
+	reply    func(message amqpMessage) ([]byte, error)
+}
+
+func newFakeAMQPPublisher() *fakeAMQPPublisher {
+	return &fakeAMQPPublisher{messages: make([]amqpMessage, 0)}
+}
+
+func (p *fakeAMQPPublisher) Publish(target *AMQPTarget, message amqpMessage) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.messages = append(p.messages, message)
+	logrus.Debugf("Fake AMQP: message published to exchange '%s' with routing key '%s'. body=%s", message.Exchange, message.RoutingKey, message.Body)
+	if p.reply == nil {
+		return nil, nil
+	}
+	return p.reply(message)
+}
+
+//Messages returns the published messages
+func (p *fakeAMQPPublisher) Messages() []amqpMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]amqpMessage{}, p.messages...)
+}
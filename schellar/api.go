@@ -1,13 +1,16 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"encoding/json"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/mgo.v2"
@@ -15,7 +18,8 @@ import (
 )
 
 var (
-	mongoSession *mgo.Session
+	mongoSession  *mgo.Session
+	callbackToken string
 )
 
 func startRestAPI() error {
@@ -27,6 +31,14 @@ func startRestAPI() error {
 	router.HandleFunc("/schedule/{name}", getSchedule).Methods("GET")
 	router.HandleFunc("/schedule/{name}", deleteSchedule).Methods("DELETE")
 	router.HandleFunc("/schedule/{name}", updateSchedule).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/schedule/{name}/workflows", listScheduleWorkflows).Methods("GET")
+	router.HandleFunc("/schedule/{name}/workflows/{workflowId}/terminate", terminateScheduleWorkflow).Methods("POST", "OPTIONS")
+	router.HandleFunc("/schedule/{name}/workflows/{workflowId}/pause", pauseScheduleWorkflow).Methods("POST", "OPTIONS")
+	router.HandleFunc("/schedule/{name}/workflows/{workflowId}/resume", resumeScheduleWorkflow).Methods("POST", "OPTIONS")
+	router.HandleFunc("/callback/workflow", workflowCallback).Methods("POST", "OPTIONS")
+	router.HandleFunc("/pending", listPendingTriggers).Methods("GET")
+	router.HandleFunc("/pending/{id}/retry", retryPendingTrigger).Methods("POST", "OPTIONS")
+	router.HandleFunc("/pending/{id}/discard", discardPendingTrigger).Methods("POST", "OPTIONS")
 	router.Handle("/metrics", promhttp.Handler())
 	listen := fmt.Sprintf("0.0.0.0:3000")
 	logrus.Infof("Listening at %s", listen)
@@ -53,6 +65,10 @@ func createSchedule(w http.ResponseWriter, r *http.Request) {
 		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Error handling post results. err=%s", err.Error()))
 		return
 	}
+	warnings, ok := validateScheduleWorkflow(w, &schedule)
+	if !ok {
+		return
+	}
 
 	sc := mongoSession.Copy()
 	defer sc.Close()
@@ -71,7 +87,7 @@ func createSchedule(w http.ResponseWriter, r *http.Request) {
 	}
 
 	logrus.Debugf("Saving schedule %s for workflow %s", schedule.Name, schedule.WorkflowName)
-	logrus.Debugf("schedule: %v", schedule)
+	logrus.Debugf("schedule: %v", schedule.redacted())
 	err0 := st.Insert(schedule)
 	if err0 != nil {
 		writeResponse(w, http.StatusInternalServerError, "Error storing schedule.")
@@ -80,9 +96,7 @@ func createSchedule(w http.ResponseWriter, r *http.Request) {
 	}
 	prepareTimers()
 	logrus.Debugf("Sending response")
-	w.Header().Set("Content-Type", "plain/text")
-	w.Header().Set("Cache-Control", "no-store")
-	w.WriteHeader(http.StatusCreated)
+	writeResponseWithWarnings(w, http.StatusCreated, fmt.Sprintf("Schedule created successfully"), warnings)
 }
 
 func updateSchedule(w http.ResponseWriter, r *http.Request) {
@@ -102,21 +116,30 @@ func updateSchedule(w http.ResponseWriter, r *http.Request) {
 		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Error handling post results. err=%s", err.Error()))
 		return
 	}
+	warnings, ok := validateScheduleWorkflow(w, &schedule)
+	if !ok {
+		return
+	}
 
 	sc := mongoSession.Copy()
 	defer sc.Close()
 	st := sc.DB(dbName).C("schedules")
 
-	logrus.Debugf("Updating schedule with %v", schedule)
-	c, err1 := st.Find(bson.M{"name": name}).Count()
+	logrus.Debugf("Updating schedule with %v", schedule.redacted())
+	var stored Schedule
+	err1 := st.Find(bson.M{"name": name}).One(&stored)
+	if err1 == mgo.ErrNotFound {
+		writeResponse(w, http.StatusNotFound, fmt.Sprintf("Couldn't find schedule %s", name))
+		return
+	}
 	if err1 != nil {
 		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error updating schedule"))
 		logrus.Errorf("Couldn't find schedule name %s. err=%s", name, err1)
 		return
 	}
-	if c == 0 {
-		writeResponse(w, http.StatusNotFound, fmt.Sprintf("Couldn't find schedule %s", name))
-		return
+	//secrets are redacted when schedules are read, so keep the stored ones if they are sent back unchanged
+	if schedule.Target != nil {
+		schedule.Target.keepSecrets(stored.Target)
 	}
 	err = st.Update(bson.M{"name": name}, bson.M{"$set": schedule})
 	if err != nil {
@@ -125,7 +148,17 @@ func updateSchedule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	prepareTimers()
-	writeResponse(w, http.StatusOK, fmt.Sprintf("Schedule updated successfully"))
+	if !schedule.Enabled && r.URL.Query().Get("terminateRunning") == "true" {
+		terminated, err := terminateRuns(name, "Schedule disabled")
+		if len(terminated) > 0 {
+			checkScheduleRuns(name, terminated)
+		}
+		if err != nil {
+			writeResponse(w, http.StatusBadGateway, fmt.Sprintf("Schedule updated, but couldn't terminate running workflows. err=%s", err.Error()))
+			return
+		}
+	}
+	writeResponseWithWarnings(w, http.StatusOK, fmt.Sprintf("Schedule updated successfully"), warnings)
 }
 
 func listSchedules(w http.ResponseWriter, r *http.Request) {
@@ -143,6 +176,10 @@ func listSchedules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for i := range schedules {
+		schedules[i] = schedules[i].redacted()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	logrus.Debugf("Schedules=%v", schedules)
 	b, err0 := json.Marshal(schedules)
@@ -171,7 +208,7 @@ func getSchedule(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	b, err0 := json.Marshal(schedule)
+	b, err0 := json.Marshal(schedule.redacted())
 	if err0 != nil {
 		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error getting schedule. err=%s", err.Error()))
 		return
@@ -188,6 +225,17 @@ func deleteSchedule(w http.ResponseWriter, r *http.Request) {
 	defer sc.Close()
 	st := sc.DB(dbName).C("schedules")
 
+	if r.URL.Query().Get("terminateRunning") == "true" {
+		terminated, err := terminateRuns(name, "Schedule deleted")
+		for workflowID, wf := range terminated {
+			finishRun(Run{WorkflowID: workflowID, ScheduleName: name}, wf.Status, wf.Output)
+		}
+		if err != nil {
+			writeResponse(w, http.StatusBadGateway, fmt.Sprintf("Couldn't terminate running workflows. Schedule was not deleted. err=%s", err.Error()))
+			return
+		}
+	}
+
 	err := st.Remove(bson.M{"name": name})
 	if err != nil {
 		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error deleting schedule. err=%s", err.Error()))
@@ -197,6 +245,311 @@ func deleteSchedule(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, http.StatusOK, fmt.Sprintf("Deleted schedule successfully. name=%s", name))
 }
 
+//scheduleWorkflow a run of a schedule with the current status of its workflow in Conductor
+type scheduleWorkflow struct {
+	Run
+	WorkflowStatus string `json:"workflowStatus,omitempty"`
+}
+
+func listScheduleWorkflows(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("listScheduleWorkflows r=%v", r)
+	name := mux.Vars(r)["name"]
+
+	runs, err := findRuns(name, r.URL.Query().Get("status"))
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error listing workflows. err=%s", err.Error()))
+		return
+	}
+
+	//runs that are still running may be paused in Conductor
+	workflows := make([]scheduleWorkflow, 0)
+	for _, run := range runs {
+		sw := scheduleWorkflow{Run: run}
+		if run.Status == "RUNNING" {
+			wf, err := run.getWorkflow()
+			if err != nil {
+				logrus.Warnf("Couldn't get workflow %s from Conductor. err=%s", run.WorkflowID, err)
+			} else {
+				sw.WorkflowStatus = wf.Status
+			}
+		}
+		workflows = append(workflows, sw)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, err0 := json.Marshal(workflows)
+	if err0 != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error listing workflows. err=%s", err0.Error()))
+		return
+	}
+	w.Write(b)
+	logrus.Debugf("result: %s", string(b))
+}
+
+func terminateScheduleWorkflow(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("terminateScheduleWorkflow r=%v", r)
+	run, ok := getScheduleRun(w, r)
+	if !ok {
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Terminated by schellar API"
+	}
+	wf, err := run.terminate(reason)
+	if err != nil {
+		writeResponse(w, http.StatusBadGateway, fmt.Sprintf("Error terminating workflow. err=%s", err.Error()))
+		return
+	}
+	checkScheduleRuns(run.ScheduleName, map[string]*Workflow{wf.WorkflowID: wf})
+	writeResponse(w, http.StatusOK, fmt.Sprintf("Workflow %s terminated", run.WorkflowID))
+}
+
+func pauseScheduleWorkflow(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("pauseScheduleWorkflow r=%v", r)
+	run, ok := getScheduleRun(w, r)
+	if !ok {
+		return
+	}
+	if run.Target != "" && run.Target != conductorTarget {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Only Conductor workflows can be paused. target=%s", run.Target))
+		return
+	}
+	client, err := run.conductorClient()
+	if err == nil {
+		err = client.PauseWorkflow(run.WorkflowID)
+	}
+	if err != nil {
+		writeResponse(w, http.StatusBadGateway, fmt.Sprintf("Error pausing workflow. err=%s", err.Error()))
+		return
+	}
+	logrus.Infof("Schedule %s: Workflow %s paused", run.ScheduleName, run.WorkflowID)
+	writeResponse(w, http.StatusOK, fmt.Sprintf("Workflow %s paused", run.WorkflowID))
+}
+
+func resumeScheduleWorkflow(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("resumeScheduleWorkflow r=%v", r)
+	run, ok := getScheduleRun(w, r)
+	if !ok {
+		return
+	}
+	if run.Target != "" && run.Target != conductorTarget {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Only Conductor workflows can be resumed. target=%s", run.Target))
+		return
+	}
+	client, err := run.conductorClient()
+	if err == nil {
+		err = client.ResumeWorkflow(run.WorkflowID)
+	}
+	if err != nil {
+		writeResponse(w, http.StatusBadGateway, fmt.Sprintf("Error resuming workflow. err=%s", err.Error()))
+		return
+	}
+	logrus.Infof("Schedule %s: Workflow %s resumed", run.ScheduleName, run.WorkflowID)
+	writeResponse(w, http.StatusOK, fmt.Sprintf("Workflow %s resumed", run.WorkflowID))
+}
+
+//getScheduleRun gets the running run of the request path, writing an error response if it doesn't belong to the schedule or already finished
+func getScheduleRun(w http.ResponseWriter, r *http.Request) (Run, bool) {
+	name := mux.Vars(r)["name"]
+	workflowID := mux.Vars(r)["workflowId"]
+
+	run, err := getRun(workflowID)
+	if err == mgo.ErrNotFound || (err == nil && run.ScheduleName != name) {
+		writeResponse(w, http.StatusNotFound, fmt.Sprintf("Workflow %s was not launched by schedule %s", workflowID, name))
+		return run, false
+	}
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error getting run. err=%s", err.Error()))
+		return run, false
+	}
+	if run.Status != "RUNNING" {
+		writeResponse(w, http.StatusConflict, fmt.Sprintf("Workflow %s is not running. status=%s", workflowID, run.Status))
+		return run, false
+	}
+	return run, true
+}
+
+//workflowCallback receives workflow finish notifications (for example, from a Conductor failure workflow)
+//so that runs are updated right away instead of on the next status check.
+//Only the workflowId is used. The status and output are read from the run's target
+func workflowCallback(w http.ResponseWriter, r *http.Request) {
+	//the request isn't logged because it carries the callback token
+	logrus.Debugf("workflowCallback %s %s", r.Method, r.URL.Path)
+	if callbackToken != "" && !validCallbackToken(r.Header.Get("X-Schellar-Token")) && !validCallbackToken(r.URL.Query().Get("token")) {
+		writeResponse(w, http.StatusUnauthorized, "Invalid callback token")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var wf Workflow
+	err := decoder.Decode(&wf)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Error handling post results. err=%s", err.Error()))
+		return
+	}
+	if wf.WorkflowID == "" {
+		writeResponse(w, http.StatusBadRequest, "'workflowId' is required")
+		return
+	}
+
+	run, err := getRun(wf.WorkflowID)
+	if err == mgo.ErrNotFound {
+		writeResponse(w, http.StatusNotFound, fmt.Sprintf("Workflow %s was not launched by schellar", wf.WorkflowID))
+		return
+	}
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error getting run. err=%s", err.Error()))
+		return
+	}
+
+	//the notification is only a hint. The workflow state is always read from its target
+	wf0, err := run.getWorkflow()
+	if err != nil {
+		writeResponse(w, http.StatusBadGateway, fmt.Sprintf("Error getting workflow status. err=%s", err.Error()))
+		return
+	}
+	wf = *wf0
+	if run.Status != "RUNNING" || !isWorkflowFinished(wf.Status) {
+		writeResponse(w, http.StatusOK, fmt.Sprintf("Nothing to update for workflow %s. status=%s", wf.WorkflowID, wf.Status))
+		return
+	}
+
+	logrus.Infof("Schedule %s: Workflow %s notified as %s", run.ScheduleName, wf.WorkflowID, wf.Status)
+	checkScheduleRuns(run.ScheduleName, map[string]*Workflow{wf.WorkflowID: &wf})
+	writeResponse(w, http.StatusOK, fmt.Sprintf("Workflow %s updated to %s", wf.WorkflowID, wf.Status))
+}
+
+//validCallbackToken compares the token in constant time, so that it can't be guessed from response times
+func validCallbackToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(callbackToken)) == 1
+}
+
+func listPendingTriggers(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("listPendingTriggers r=%v", r)
+
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	pt := sc.DB(dbName).C("pendingTriggers")
+
+	query := bson.M{}
+	status := r.URL.Query().Get("status")
+	if status != "" {
+		query["status"] = status
+	}
+	scheduleName := r.URL.Query().Get("scheduleName")
+	if scheduleName != "" {
+		query["scheduleName"] = scheduleName
+	}
+
+	triggers := make([]PendingTrigger, 0)
+	err := pt.Find(query).Sort("triggerDate").All(&triggers)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error listing pending triggers. err=%s", err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, err0 := json.Marshal(triggers)
+	if err0 != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error listing pending triggers. err=%s", err0.Error()))
+		return
+	}
+	w.Write(b)
+	logrus.Debugf("result: %s", string(b))
+}
+
+func retryPendingTrigger(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("retryPendingTrigger r=%v", r)
+	id := mux.Vars(r)["id"]
+	if !bson.IsObjectIdHex(id) {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid pending trigger id %s", id))
+		return
+	}
+
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	pt := sc.DB(dbName).C("pendingTriggers")
+
+	err := pt.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"status": "PENDING", "attempts": 0, "nextAttemptDate": time.Now()}})
+	if err == mgo.ErrNotFound {
+		writeResponse(w, http.StatusNotFound, fmt.Sprintf("Couldn't find pending trigger %s", id))
+		return
+	}
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error updating pending trigger. err=%s", err.Error()))
+		return
+	}
+	signalPendingTriggers()
+	writeResponse(w, http.StatusOK, fmt.Sprintf("Pending trigger %s will be replayed", id))
+}
+
+func discardPendingTrigger(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("discardPendingTrigger r=%v", r)
+	id := mux.Vars(r)["id"]
+	if !bson.IsObjectIdHex(id) {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid pending trigger id %s", id))
+		return
+	}
+
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	pt := sc.DB(dbName).C("pendingTriggers")
+
+	var trigger PendingTrigger
+	err := pt.FindId(bson.ObjectIdHex(id)).One(&trigger)
+	if err == mgo.ErrNotFound {
+		writeResponse(w, http.StatusNotFound, fmt.Sprintf("Couldn't find pending trigger %s", id))
+		return
+	}
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error discarding pending trigger. err=%s", err.Error()))
+		return
+	}
+	//kept as DISCARDED, like triggers discarded by the outbox, so that it can still be inspected and replayed manually
+	err = pt.UpdateId(trigger.ID, bson.M{"$set": bson.M{"status": "DISCARDED", "lastError": "Discarded manually"}})
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error discarding pending trigger. err=%s", err.Error()))
+		return
+	}
+	discardedTriggersCounter.WithLabelValues(trigger.ScheduleName, "manual").Inc()
+	logrus.Infof("Schedule %s: Pending trigger %s discarded", trigger.ScheduleName, id)
+	writeResponse(w, http.StatusOK, fmt.Sprintf("Discarded pending trigger successfully. id=%s", id))
+}
+
+//validateScheduleWorkflow checks the schedule workflow against Conductor definitions, writing an error response if it is invalid
+func validateScheduleWorkflow(w http.ResponseWriter, schedule *Schedule) ([]string, bool) {
+	if !validateWorkflows || schedule.targetType() != conductorTarget {
+		return nil, true
+	}
+	warnings, err := schedule.ValidateWorkflow()
+	if errors.Cause(err) == errWorkflowDefNotFound {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid workflow. err=%s", err.Error()))
+		return nil, false
+	}
+	if err != nil {
+		writeResponse(w, http.StatusBadGateway, fmt.Sprintf("Error validating workflow. err=%s", err.Error()))
+		logrus.Errorf("Error validating workflow of schedule %s. err=%s", schedule.Name, err)
+		return nil, false
+	}
+	for _, warning := range warnings {
+		logrus.Warnf("Schedule %s: %s", schedule.Name, warning)
+	}
+	return warnings, true
+}
+
+func writeResponseWithWarnings(w http.ResponseWriter, statusCode int, message string, warnings []string) {
+	msg := make(map[string]interface{})
+	msg["message"] = message
+	if len(warnings) > 0 {
+		msg["warnings"] = warnings
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(msg)
+}
+
 func writeResponse(w http.ResponseWriter, statusCode int, message string) {
 	msg := make(map[string]string)
 	msg["message"] = message
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func postCallback(body string) int {
+	r := httptest.NewRequest("POST", "/callback/workflow", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	workflowCallback(w, r)
+	return w.Code
+}
+
+func TestWorkflowCallbackReadsStatusFromTarget(t *testing.T) {
+	conductor := setupScheduler(t)
+	callbackToken = ""
+	schedule := createTestSchedule(t, Schedule{Name: "s1", WorkflowName: "encode"})
+	err := startScheduledRun(schedule, Trigger{FireTime: time.Now()})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	run := runningTestRun(t, "s1")
+
+	//status and output in the body must not be trusted
+	code := postCallback(`{"workflowId":"` + run.WorkflowID + `","status":"COMPLETED","output":{"lastDate":"{{ .Now }}"}}`)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected callback response %d", code)
+	}
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "RUNNING" || schedule.WorkflowContext["lastDate"] != nil {
+		t.Fatalf("Expected callback of a running workflow to change nothing, got %s %v", schedule.Status, schedule.WorkflowContext)
+	}
+
+	conductor.FinishWorkflow(run.WorkflowID, "COMPLETED", map[string]interface{}{"lastDate": "2019-01-15"})
+	code = postCallback(`{"workflowId":"` + run.WorkflowID + `"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected callback response %d", code)
+	}
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "COMPLETED" || schedule.WorkflowContext["lastDate"] != "2019-01-15" {
+		t.Errorf("Expected schedule COMPLETED with the workflow output, got %s %v", schedule.Status, schedule.WorkflowContext)
+	}
+
+	if postCallback(`{"workflowId":"unknown"}`) != http.StatusNotFound {
+		t.Errorf("Expected unknown workflows to be rejected")
+	}
+}
+
+func TestScheduleSecretsAreRedacted(t *testing.T) {
+	setupScheduler(t)
+	createTestSchedule(t, Schedule{
+		Name:         "s1",
+		WorkflowName: "publish",
+		Target:       &Target{Type: redisTarget, Redis: &RedisTarget{URL: "redis://:s3cret@redis:6379/0", Key: "jobs"}},
+	})
+	getLogs := captureLogs()
+
+	w := httptest.NewRecorder()
+	listSchedules(w, httptest.NewRequest("GET", "/schedule", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "s3cret") || !strings.Contains(w.Body.String(), "redis://REDACTED@redis:6379/0") {
+		t.Errorf("Expected redacted schedule list, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	getSchedule(w, mux.SetURLVars(httptest.NewRequest("GET", "/schedule/s1", nil), map[string]string{"name": "s1"}))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("Expected redacted schedule, got %d %s", w.Code, w.Body.String())
+	}
+
+	//sending the redacted schedule back keeps the stored secret
+	r := httptest.NewRequest("PUT", "/schedule/s1", strings.NewReader(w.Body.String()))
+	w = httptest.NewRecorder()
+	updateSchedule(w, mux.SetURLVars(r, map[string]string{"name": "s1"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected update response %d %s", w.Code, w.Body.String())
+	}
+	if url := loadTestSchedule(t, "s1").Target.Redis.URL; url != "redis://:s3cret@redis:6379/0" {
+		t.Errorf("Expected stored URL to be kept, got %s", url)
+	}
+
+	if logs := getLogs(); strings.Contains(logs, "s3cret") {
+		t.Errorf("Expected secrets not to be logged, got %s", logs)
+	}
+}
+
+func TestWorkflowCallbackToken(t *testing.T) {
+	previous := callbackToken
+	defer func() { callbackToken = previous }()
+	callbackToken = "s3cret"
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		valid  bool
+	}{
+		{"header", "s3cret", "", true},
+		{"query", "", "s3cret", true},
+		{"missing", "", "", false},
+		{"wrong", "s3cre", "other", false},
+		{"longer", "s3cret1", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/callback/workflow?token="+test.query, strings.NewReader(`{}`))
+		if test.header != "" {
+			r.Header.Set("X-Schellar-Token", test.header)
+		}
+		w := httptest.NewRecorder()
+		getLogs := captureLogs()
+		workflowCallback(w, r)
+		logs := getLogs()
+		//valid tokens get to body validation, which rejects the empty workflowId
+		if (w.Code != http.StatusUnauthorized) != test.valid {
+			t.Errorf("%s: expected valid=%t, got status %d", test.name, test.valid, w.Code)
+		}
+		if strings.Contains(logs, "s3cret") {
+			t.Errorf("%s: expected token not to be logged, got %s", test.name, logs)
+		}
+	}
+}
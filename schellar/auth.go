@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//ConductorAuthConfig credentials used to call a Conductor API. At most one of token, username/password,
+//OAuth2 client credentials or key id/secret may be set. Headers are sent in addition to them
+type ConductorAuthConfig struct {
+	Token              string            `json:"token,omitempty"`
+	Username           string            `json:"username,omitempty"`
+	Password           string            `json:"password,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	OAuth2TokenURL     string            `json:"oauth2TokenUrl,omitempty"`
+	OAuth2ClientID     string            `json:"oauth2ClientId,omitempty"`
+	OAuth2ClientSecret string            `json:"oauth2ClientSecret,omitempty"`
+	OAuth2Scopes       []string          `json:"oauth2Scopes,omitempty"`
+	KeyID              string            `json:"keyId,omitempty"`
+	KeySecret          string            `json:"keySecret,omitempty"`
+}
+
+//conductorAuth adds credentials to requests sent to Conductor
+type conductorAuth interface {
+	Authorize(req *http.Request) error
+	//Invalidate drops cached tokens so that new ones are fetched on the next request.
+	//Returns false if there is nothing to refresh
+	Invalidate() bool
+}
+
+//newConductorAuth creates the authenticator for the given configuration. Returns nil if no credentials are configured
+func newConductorAuth(config ConductorAuthConfig, baseURL string, httpClient *http.Client) (conductorAuth, error) {
+	auths := make(multiAuth, 0)
+	if len(config.Headers) > 0 {
+		auths = append(auths, headersAuth{headers: config.Headers})
+	}
+
+	methods := 0
+	if config.Token != "" {
+		methods++
+		auths = append(auths, bearerTokenAuth{token: config.Token})
+	}
+	if config.Username != "" {
+		methods++
+		auths = append(auths, basicAuth{username: config.Username, password: config.Password})
+	}
+	if config.OAuth2TokenURL != "" {
+		methods++
+		if config.OAuth2ClientID == "" {
+			return nil, fmt.Errorf("OAuth2 client id is required")
+		}
+		auths = append(auths, &cachedTokenAuth{fetch: oauth2ClientCredentialsToken(config, httpClient)})
+	}
+	if config.KeyID != "" {
+		methods++
+		auths = append(auths, &cachedTokenAuth{fetch: keySecretToken(config, baseURL, httpClient), header: "X-Authorization", noBearerPrefix: true})
+	}
+	if methods > 1 {
+		return nil, fmt.Errorf("Only one of token, username/password, OAuth2 client credentials or key id/secret may be configured")
+	}
+
+	if len(auths) == 0 {
+		return nil, nil
+	}
+	return auths, nil
+}
+
+//parseHeaders parses headers in the form "[name]=[value],..."
+func parseHeaders(spec string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if strings.TrimSpace(spec) == "" {
+		return headers, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid header '%s'. Use [name]=[value]", entry)
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers, nil
+}
+
+type multiAuth []conductorAuth
+
+func (a multiAuth) Authorize(req *http.Request) error {
+	for _, auth := range a {
+		err := auth.Authorize(req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a multiAuth) Invalidate() bool {
+	invalidated := false
+	for _, auth := range a {
+		if auth.Invalidate() {
+			invalidated = true
+		}
+	}
+	return invalidated
+}
+
+type headersAuth struct {
+	headers map[string]string
+}
+
+func (a headersAuth) Authorize(req *http.Request) error {
+	for k, v := range a.headers {
+		req.Header.Set(k, v)
+	}
+	return nil
+}
+
+func (a headersAuth) Invalidate() bool {
+	return false
+}
+
+type bearerTokenAuth struct {
+	token string
+}
+
+func (a bearerTokenAuth) Authorize(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+func (a bearerTokenAuth) Invalidate() bool {
+	return false
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a basicAuth) Authorize(req *http.Request) error {
+	req.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+func (a basicAuth) Invalidate() bool {
+	return false
+}
+
+//tokenFetcher gets a new token and how long it is valid
+type tokenFetcher func() (string, time.Duration, error)
+
+//cachedTokenAuth sends a token obtained from a token endpoint, fetching a new one shortly before it expires
+type cachedTokenAuth struct {
+	fetch          tokenFetcher
+	header         string
+	noBearerPrefix bool
+
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (a *cachedTokenAuth) Authorize(req *http.Request) error {
+	token, err := a.currentToken()
+	if err != nil {
+		return err
+	}
+	header := a.header
+	if header == "" {
+		header = "Authorization"
+	}
+	if a.noBearerPrefix {
+		req.Header.Set(header, token)
+	} else {
+		req.Header.Set(header, "Bearer "+token)
+	}
+	return nil
+}
+
+func (a *cachedTokenAuth) Invalidate() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.token = ""
+	return true
+}
+
+func (a *cachedTokenAuth) currentToken() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	//refresh a bit before expiration so that in flight requests don't fail
+	if a.token != "" && time.Now().Add(30*time.Second).Before(a.expiry) {
+		return a.token, nil
+	}
+	token, validity, err := a.fetch()
+	if err != nil {
+		return "", err
+	}
+	logrus.Debugf("Got new Conductor access token valid for %s", validity)
+	a.token = token
+	a.expiry = time.Now().Add(validity)
+	return a.token, nil
+}
+
+//oauth2ClientCredentialsToken fetches tokens using the OAuth2 client credentials grant
+func oauth2ClientCredentialsToken(config ConductorAuthConfig, httpClient *http.Client) tokenFetcher {
+	return func() (string, time.Duration, error) {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		if len(config.OAuth2Scopes) > 0 {
+			form.Set("scope", strings.Join(config.OAuth2Scopes, " "))
+		}
+		req, err := http.NewRequest("POST", config.OAuth2TokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(url.QueryEscape(config.OAuth2ClientID), url.QueryEscape(config.OAuth2ClientSecret))
+
+		resp, data, err := doSecretHTTP(httpClient, req)
+		if err != nil {
+			return "", 0, fmt.Errorf("OAuth2 token request failed. err=%s", err)
+		}
+		if resp.StatusCode != 200 {
+			return "", 0, fmt.Errorf("OAuth2 token request failed. status=%d", resp.StatusCode)
+		}
+		var tokenResponse struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		err = json.Unmarshal(data, &tokenResponse)
+		if err != nil {
+			return "", 0, fmt.Errorf("Invalid OAuth2 token response. err=%s", err)
+		}
+		if tokenResponse.AccessToken == "" {
+			return "", 0, fmt.Errorf("OAuth2 token response has no access_token")
+		}
+		validity := time.Duration(tokenResponse.ExpiresIn) * time.Second
+		if validity <= 0 {
+			validity = time.Hour
+		}
+		return tokenResponse.AccessToken, validity, nil
+	}
+}
+
+//keySecretToken fetches tokens from the Conductor server itself using an application key id and secret (Orkes style)
+func keySecretToken(config ConductorAuthConfig, baseURL string, httpClient *http.Client) tokenFetcher {
+	return func() (string, time.Duration, error) {
+		body, _ := json.Marshal(map[string]string{"keyId": config.KeyID, "keySecret": config.KeySecret})
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/token", baseURL), bytes.NewBuffer(body))
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, data, err := doSecretHTTP(httpClient, req)
+		if err != nil {
+			return "", 0, fmt.Errorf("POST /token failed. err=%s", err)
+		}
+		if resp.StatusCode != 200 {
+			return "", 0, fmt.Errorf("POST /token failed. status=%d", resp.StatusCode)
+		}
+		var tokenResponse struct {
+			Token string `json:"token"`
+		}
+		err = json.Unmarshal(data, &tokenResponse)
+		if err != nil {
+			return "", 0, fmt.Errorf("Invalid token response. err=%s", err)
+		}
+		if tokenResponse.Token == "" {
+			return "", 0, fmt.Errorf("Token response has no token")
+		}
+		//tokens don't carry their expiration in the response. Refresh periodically and on 401
+		return tokenResponse.Token, 30 * time.Minute, nil
+	}
+}
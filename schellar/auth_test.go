@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//captureLogs returns the debug logs written until the returned function is called
+func captureLogs() func() string {
+	var b bytes.Buffer
+	level := logrus.GetLevel()
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(&b)
+	logrus.SetLevel(logrus.DebugLevel)
+	return func() string {
+		logrus.SetOutput(out)
+		logrus.SetLevel(level)
+		return b.String()
+	}
+}
+
+func TestCachedTokenAuthExpiry(t *testing.T) {
+	tests := []struct {
+		validity time.Duration
+		fetches  int
+	}{
+		//tokens are reused until 30s before they expire
+		{time.Hour, 1},
+		{10 * time.Second, 3},
+	}
+	for _, test := range tests {
+		fetches := 0
+		auth := &cachedTokenAuth{fetch: func() (string, time.Duration, error) {
+			fetches++
+			return fmt.Sprintf("token%d", fetches), test.validity, nil
+		}}
+		for i := 0; i < 3; i++ {
+			req, _ := http.NewRequest("GET", "http://conductor/api", nil)
+			err := auth.Authorize(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Header.Get("Authorization") != fmt.Sprintf("Bearer token%d", fetches) {
+				t.Errorf("Unexpected Authorization header %s", req.Header.Get("Authorization"))
+			}
+		}
+		if fetches != test.fetches {
+			t.Errorf("validity=%s: expected %d token fetches, got %d", test.validity, test.fetches, fetches)
+		}
+	}
+
+	fetches := 0
+	auth := &cachedTokenAuth{header: "X-Authorization", noBearerPrefix: true, fetch: func() (string, time.Duration, error) {
+		fetches++
+		return fmt.Sprintf("token%d", fetches), time.Hour, nil
+	}}
+	req, _ := http.NewRequest("GET", "http://conductor/api", nil)
+	auth.Authorize(req)
+	if !auth.Invalidate() {
+		t.Errorf("Expected cached tokens to be refreshable")
+	}
+	auth.Authorize(req)
+	if fetches != 2 || req.Header.Get("X-Authorization") != "token2" {
+		t.Errorf("Expected a new token after Invalidate, got %d fetches and %s", fetches, req.Header.Get("X-Authorization"))
+	}
+}
+
+func TestOAuth2TokenUsesClusterClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "a b" || id != "schellar" || secret != "s3cret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token": "oauth2-token-value", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	config := ConductorAuthConfig{OAuth2TokenURL: server.URL, OAuth2ClientID: "schellar", OAuth2ClientSecret: "s3cret", OAuth2Scopes: []string{"a", "b"}}
+	//the test server certificate is only trusted by its own client
+	_, _, err := oauth2ClientCredentialsToken(config, defaultHTTPClient)()
+	if err == nil {
+		t.Fatalf("Expected the default client not to trust the test server")
+	}
+
+	logs := captureLogs()
+	token, validity, err := oauth2ClientCredentialsToken(config, server.Client())()
+	output := logs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "oauth2-token-value" || validity != time.Hour {
+		t.Errorf("Unexpected token %s valid for %s", token, validity)
+	}
+	if strings.Contains(output, "oauth2-token-value") {
+		t.Errorf("Expected token not to be logged. logs=%s", output)
+	}
+}
+
+func TestKeySecretTokenIsNotLogged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path != "/api/token" || body["keyId"] != "key1" || body["keySecret"] != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token": "orkes-token-value"}`))
+	}))
+	defer server.Close()
+
+	logs := captureLogs()
+	token, _, err := keySecretToken(ConductorAuthConfig{KeyID: "key1", KeySecret: "s3cret"}, server.URL+"/api", server.Client())()
+	output := logs()
+	if err != nil || token != "orkes-token-value" {
+		t.Fatalf("Unexpected token %s. err=%v", token, err)
+	}
+	if strings.Contains(output, "orkes-token-value") {
+		t.Errorf("Expected token not to be logged. logs=%s", output)
+	}
+}
+
+func TestCallRetriesOnceWithRefreshedToken(t *testing.T) {
+	for _, acceptedToken := range []string{"token2", "never"} {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("Authorization") != "Bearer "+acceptedToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{}`))
+		}))
+		fetches := 0
+		auth := &cachedTokenAuth{fetch: func() (string, time.Duration, error) {
+			fetches++
+			return fmt.Sprintf("token%d", fetches), time.Hour, nil
+		}}
+		client := newHTTPConductorClient(server.URL, auth, server.Client())
+
+		resp, _, err := client.call("GET", server.URL+"/workflow/1", nil)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedStatus := http.StatusOK
+		if acceptedToken == "never" {
+			expectedStatus = http.StatusUnauthorized
+		}
+		if resp.StatusCode != expectedStatus || requests != 2 || fetches != 2 {
+			t.Errorf("accepted=%s: expected status %d after 2 requests and 2 token fetches, got %d, %d and %d", acceptedToken, expectedStatus, resp.StatusCode, requests, fetches)
+		}
+	}
+}
+
+func TestNewConductorAuthSingleMethod(t *testing.T) {
+	configs := []ConductorAuthConfig{
+		{Token: "t", Username: "u", Password: "p"},
+		{Token: "t", OAuth2TokenURL: "http://idp/token", OAuth2ClientID: "c"},
+		{Username: "u", KeyID: "k", KeySecret: "s"},
+	}
+	for _, config := range configs {
+		_, err := newConductorAuth(config, "http://conductor/api", defaultHTTPClient)
+		if err == nil || !strings.HasPrefix(err.Error(), "Only one of token") {
+			t.Errorf("Expected conflicting credentials to be invalid, got %v", err)
+		}
+	}
+
+	auth, err := newConductorAuth(ConductorAuthConfig{Token: "t", Headers: map[string]string{"X-Tenant": "abc"}}, "http://conductor/api", defaultHTTPClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://conductor/api", nil)
+	auth.Authorize(req)
+	if req.Header.Get("Authorization") != "Bearer t" || req.Header.Get("X-Tenant") != "abc" {
+		t.Errorf("Unexpected headers %v", req.Header)
+	}
+	if auth.Invalidate() {
+		t.Errorf("Expected static token not to be refreshable")
+	}
+}
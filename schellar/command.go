@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const commandTarget = "command"
+
+//CommandTarget runs a local command on each trigger
+type CommandTarget struct {
+	//Command executable and its arguments
+	Command []string `json:"command" bson:"command"`
+	//Dir working directory, relative to the 'command-dir-root'
+	Dir string `json:"dir,omitempty" bson:"dir,omitempty"`
+	//Env additional environment variables. Input values are always passed as environment variables.
+	//Variables that change how executables are found or loaded (like PATH, LD_PRELOAD or BASH_ENV) can't be set
+	Env map[string]string `json:"env,omitempty" bson:"env,omitempty"`
+	//InheritEnv passes the environment of schellar to the command. Otherwise only PATH is passed
+	InheritEnv     bool `json:"inheritEnv,omitempty" bson:"inheritEnv,omitempty"`
+	TimeoutSeconds int  `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+	//KillGraceSeconds time between SIGTERM and SIGKILL when the command is cancelled or times out
+	KillGraceSeconds int `json:"killGraceSeconds,omitempty" bson:"killGraceSeconds,omitempty"`
+}
+
+//commandProcess a command started by schellar that is still running
+type commandProcess struct {
+	cmd       *exec.Cmd
+	startTime time.Time
+	killGrace time.Duration
+	cancelled chan string
+	done      chan bool
+}
+
+//commandCancelWait maximum time Cancel waits for a command to exit. Cancel may be called while run statuses
+//are locked, so commands that take longer (see killGraceSeconds) report their final state when they exit
+const commandCancelWait = 2 * time.Second
+
+var (
+	commandProcessesMutex sync.Mutex
+	commandProcesses      = make(map[string]*commandProcess)
+
+	//commandTargetEnabled command targets run local commands with the privileges of schellar, so they must be enabled by the operator
+	commandTargetEnabled = false
+	//commandAllowedExecutables executables command targets can run
+	commandAllowedExecutables = make(map[string]bool)
+	//commandDirRoot directory under which command targets may set their working directory. 'dir' is disabled if empty
+	commandDirRoot = ""
+
+	//commandProtectedEnv variables that would let schedules run other executables than the allowed ones
+	commandProtectedEnv = map[string]bool{
+		"PATH": true, "IFS": true, "ENV": true, "BASH_ENV": true, "SHELLOPTS": true, "BASHOPTS": true,
+		"PS4": true, "CDPATH": true, "GLOBIGNORE": true, "PROMPT_COMMAND": true,
+	}
+	commandProtectedEnvPrefixes = []string{"LD_", "DYLD_", "BASH_FUNC_"}
+)
+
+//commandExecutor runs local commands. Runs finish when the command exits. Running commands are only
+//tracked in memory, so their runs fail if schellar is restarted
+type commandExecutor struct{}
+
+func (e commandExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.Command
+	if target == nil || len(target.Command) == 0 || target.Command[0] == "" {
+		return errors.New("'target.command.command' is required")
+	}
+	if err := checkCommandAllowed(target); err != nil {
+		return err
+	}
+	for k := range target.Env {
+		if !isCommandEnvAllowed(k) {
+			return fmt.Errorf("'target.command.env' can't set '%s'", k)
+		}
+	}
+	for k := range schedule.WorkflowContext {
+		if !isCommandEnvAllowed(k) {
+			return fmt.Errorf("'workflowContext.%s' can't be passed to commands as environment variable", k)
+		}
+	}
+	if target.Dir != "" {
+		if _, err := commandDir(target.Dir); err != nil {
+			return fmt.Errorf("Invalid 'target.command.dir'. err=%s", err)
+		}
+	}
+	if target.TimeoutSeconds < 0 || target.KillGraceSeconds < 0 {
+		return errors.New("'target.command' timeouts must be positive")
+	}
+	if target.KillGraceSeconds == 0 {
+		target.KillGraceSeconds = 10
+	}
+	return nil
+}
+
+func (e commandExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.Command
+	//the schedule may have been saved before the executable was disallowed
+	if err := checkCommandAllowed(target); err != nil {
+		return Run{}, nil, err
+	}
+	dir := ""
+	if target.Dir != "" {
+		var err error
+		dir, err = commandDir(target.Dir)
+		if err != nil {
+			return Run{}, nil, fmt.Errorf("Invalid command dir. err=%s", err)
+		}
+	}
+	run := Run{WorkflowID: newRunID()}
+
+	cmd := exec.Command(target.Command[0], target.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = commandEnv(target, trigger, input, run.WorkflowID)
+	stdout := newTailBuffer(maxRecordedBytes)
+	stderr := newTailBuffer(maxRecordedBytes)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	//children that inherited stdout/stderr must not keep the run alive after the command was killed
+	cmd.WaitDelay = time.Duration(target.KillGraceSeconds) * time.Second
+
+	startTime := time.Now()
+	err := cmd.Start()
+	if err != nil {
+		logrus.Infof("Schedule %s: Couldn't start command %s. err=%s", schedule.Name, target.Command[0], err)
+		run.Result = map[string]interface{}{"error": err.Error()}
+		return run, &Workflow{
+			Status:                "FAILED",
+			ReasonForIncompletion: err.Error(),
+			StartTime:             startTime.UnixNano() / int64(time.Millisecond),
+			EndTime:               time.Now().UnixNano() / int64(time.Millisecond),
+		}, nil
+	}
+	logrus.Infof("Schedule %s: Command %s started. pid=%d runId=%s", schedule.Name, target.Command[0], cmd.Process.Pid, run.WorkflowID)
+
+	process := &commandProcess{
+		cmd:       cmd,
+		startTime: startTime,
+		killGrace: time.Duration(target.KillGraceSeconds) * time.Second,
+		cancelled: make(chan string, 1),
+		done:      make(chan bool),
+	}
+	commandProcessesMutex.Lock()
+	commandProcesses[run.WorkflowID] = process
+	commandProcessesMutex.Unlock()
+
+	go process.wait(schedule.Name, run.WorkflowID, time.Duration(target.TimeoutSeconds)*time.Second, stdout, stderr)
+	return run, nil, nil
+}
+
+func (e commandExecutor) Status(run Run) (*Workflow, error) {
+	commandProcessesMutex.Lock()
+	process, exists := commandProcesses[run.WorkflowID]
+	commandProcessesMutex.Unlock()
+	if !exists {
+		return lostRunState(run), nil
+	}
+	return &Workflow{
+		WorkflowID: run.WorkflowID,
+		Status:     "RUNNING",
+		StartTime:  process.startTime.UnixNano() / int64(time.Millisecond),
+	}, nil
+}
+
+func (e commandExecutor) Cancel(run Run, reason string) error {
+	commandProcessesMutex.Lock()
+	process, exists := commandProcesses[run.WorkflowID]
+	commandProcessesMutex.Unlock()
+	if !exists {
+		return fmt.Errorf("Command of run %s is not running", run.WorkflowID)
+	}
+	select {
+	case process.cancelled <- reason:
+	default:
+	}
+	//wait a little for the command to exit so that its final state is available
+	select {
+	case <-process.done:
+	case <-time.After(commandCancelWait):
+		logrus.Debugf("Command of run %s is still stopping", run.WorkflowID)
+	}
+	return nil
+}
+
+//checkCommandAllowed checks that command targets are enabled and the executable is allowed
+func checkCommandAllowed(target *CommandTarget) error {
+	if !commandTargetEnabled {
+		return errors.New("Command targets are disabled. Enable them with 'command-target-enabled'")
+	}
+	if !commandAllowedExecutables[target.Command[0]] {
+		return fmt.Errorf("Executable '%s' is not in 'command-allowed-executables'", target.Command[0])
+	}
+	return nil
+}
+
+//parseAllowedExecutables parses a comma separated list of absolute paths or names looked up in PATH
+func parseAllowedExecutables(list string) (map[string]bool, error) {
+	executables := make(map[string]bool)
+	for _, executable := range strings.Split(list, ",") {
+		executable = strings.TrimSpace(executable)
+		if executable == "" {
+			continue
+		}
+		//relative paths would depend on the 'dir' of each schedule
+		if strings.Contains(executable, "/") && !filepath.IsAbs(executable) {
+			return nil, fmt.Errorf("'%s' must be an absolute path or a name looked up in PATH", executable)
+		}
+		executables[executable] = true
+	}
+	return executables, nil
+}
+
+//wait waits for the command to exit, stopping it on timeout or cancellation, and reports its final state
+func (p *commandProcess) wait(scheduleName string, runID string, timeout time.Duration, stdout *tailBuffer, stderr *tailBuffer) {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.cmd.Wait()
+	}()
+
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	reason := ""
+	cancelled := false
+	var err error
+	select {
+	case err = <-exited:
+	case <-timeoutC:
+		reason = fmt.Sprintf("Command timed out after %s", timeout)
+		err = p.stop(exited)
+	case reason = <-p.cancelled:
+		cancelled = true
+		err = p.stop(exited)
+	}
+	endTime := time.Now()
+
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+
+	state := &Workflow{
+		WorkflowID: runID,
+		StartTime:  p.startTime.UnixNano() / int64(time.Millisecond),
+		EndTime:    endTime.UnixNano() / int64(time.Millisecond),
+		Output:     lastLineJSON(stdout.String()),
+	}
+	switch {
+	case cancelled:
+		state.Status = "TERMINATED"
+		state.ReasonForIncompletion = reason
+	case reason != "":
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = reason
+	case err != nil:
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = fmt.Sprintf("Command failed. exitCode=%d. err=%s", exitCode, err)
+	default:
+		state.Status = "COMPLETED"
+	}
+	logrus.Infof("Schedule %s: Command of run %s finished. status=%s exitCode=%d", scheduleName, runID, state.Status, exitCode)
+
+	err = recordRunResult(runID, map[string]interface{}{
+		"pid":             p.cmd.Process.Pid,
+		"exitCode":        exitCode,
+		"stdout":          stdout.String(),
+		"stderr":          stderr.String(),
+		"durationSeconds": endTime.Sub(p.startTime).Seconds(),
+	})
+	if err != nil {
+		logrus.Errorf("Couldn't record result of run %s. err=%s", runID, err)
+	}
+
+	finishedRunsMutex.Lock()
+	finishedRuns[runID] = state
+	finishedRunsMutex.Unlock()
+	commandProcessesMutex.Lock()
+	delete(commandProcesses, runID)
+	commandProcessesMutex.Unlock()
+	close(p.done)
+
+	checkScheduleRuns(scheduleName, map[string]*Workflow{runID: state})
+}
+
+//stop sends SIGTERM to the command and SIGKILL if it doesn't exit within the kill grace period
+func (p *commandProcess) stop(exited chan error) error {
+	err := p.cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		logrus.Debugf("Couldn't send SIGTERM to pid %d. err=%s", p.cmd.Process.Pid, err)
+	}
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(p.killGrace):
+		logrus.Warnf("Command pid %d didn't exit after %s. Killing it", p.cmd.Process.Pid, p.killGrace)
+		p.cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+//commandDir resolves a working directory inside the 'command-dir-root', following symlinks
+func commandDir(dir string) (string, error) {
+	if commandDirRoot == "" {
+		return "", errors.New("Working directories are disabled. Configure 'command-dir-root' to use them")
+	}
+	if !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("'%s' must be a relative path inside 'command-dir-root'", dir)
+	}
+	root, err := filepath.EvalSymlinks(commandDirRoot)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, dir))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return "", fmt.Errorf("'%s' is outside of 'command-dir-root'", dir)
+	}
+	return path, nil
+}
+
+//isCommandEnvAllowed tells whether schedules can set an environment variable of commands
+func isCommandEnvAllowed(name string) bool {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return false
+	}
+	name = strings.ToUpper(name)
+	if commandProtectedEnv[name] {
+		return false
+	}
+	for _, prefix := range commandProtectedEnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+//commandEnv environment of the command: input values (strings as is, other values as JSON) plus trigger metadata.
+//Protected variables (like PATH) keep the values of schellar
+func commandEnv(target *CommandTarget, trigger Trigger, input map[string]interface{}, runID string) []string {
+	env := make([]string, 0)
+	if target.InheritEnv {
+		env = append(env, os.Environ()...)
+	} else {
+		env = append(env, "PATH="+os.Getenv("PATH"))
+	}
+	for k, v := range messagePayload(trigger, input, runID) {
+		if !isCommandEnvAllowed(k) {
+			logrus.Debugf("Input '%s' is not passed to the command as environment variable", k)
+			continue
+		}
+		if s, ok := v.(string); ok {
+			env = append(env, fmt.Sprintf("%s=%s", k, s))
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		env = append(env, fmt.Sprintf("%s=%s", k, b))
+	}
+	for k, v := range target.Env {
+		if isCommandEnvAllowed(k) {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	return env
+}
+
+//lastLineJSON parses the last non empty line of the output as a JSON object. Returns nil if it isn't one
+func lastLineJSON(output string) map[string]interface{} {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	var m map[string]interface{}
+	if json.Unmarshal([]byte(lines[len(lines)-1]), &m) != nil {
+		return nil
+	}
+	return m
+}
+
+//tailBuffer keeps the last bytes written to it
+type tailBuffer struct {
+	mutex     sync.Mutex
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.buf.Write(p)
+	if b.buf.Len() > b.max {
+		data := b.buf.Bytes()[b.buf.Len()-b.max:]
+		kept := append([]byte{}, data...)
+		b.buf.Reset()
+		b.buf.Write(kept)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.truncated {
+		return "(truncated)..." + b.buf.String()
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func enableCommands(t *testing.T, executables string) {
+	var err error
+	commandTargetEnabled = true
+	commandAllowedExecutables, err = parseAllowedExecutables(executables)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func disableCommands() {
+	commandTargetEnabled = false
+	commandAllowedExecutables = make(map[string]bool)
+}
+
+func commandSchedule(command ...string) Schedule {
+	return Schedule{
+		Name:   "s1",
+		Target: &Target{Type: commandTarget, Command: &CommandTarget{Command: command, KillGraceSeconds: 10}},
+	}
+}
+
+func TestCommandTargetAllowed(t *testing.T) {
+	defer disableCommands()
+	disableCommands()
+	schedule := commandSchedule("/bin/sh", "-c", "echo ok")
+	if (commandExecutor{}).Validate(&schedule) == nil {
+		t.Errorf("Expected command targets to be disabled by default")
+	}
+
+	enableCommands(t, "/bin/echo, /bin/sh")
+	if err := (commandExecutor{}).Validate(&schedule); err != nil {
+		t.Errorf("Expected allowed executable to be valid. err=%s", err)
+	}
+	schedule = commandSchedule("sh", "-c", "echo ok")
+	if (commandExecutor{}).Validate(&schedule) == nil {
+		t.Errorf("Expected executables to match exactly")
+	}
+	_, _, err := commandExecutor{}.Launch(schedule, Trigger{FireTime: time.Now()}, map[string]interface{}{})
+	if err == nil {
+		t.Errorf("Expected launch of a disallowed executable to fail")
+	}
+
+	_, err = parseAllowedExecutables("scripts/cleanup.sh")
+	if err == nil {
+		t.Errorf("Expected relative paths to be rejected")
+	}
+}
+
+func TestCommandCancelDoesNotBlock(t *testing.T) {
+	setupScheduler(t)
+	defer disableCommands()
+	enableCommands(t, "/bin/sh")
+	//the command ignores SIGTERM, so it is only stopped after killGraceSeconds
+	schedule := createTestSchedule(t, commandSchedule("/bin/sh", "-c", "trap '' TERM; sleep 30"))
+	err := startScheduledRun(schedule, Trigger{FireTime: time.Now()})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	run := runningTestRun(t, "s1")
+
+	start := time.Now()
+	err = commandExecutor{}.Cancel(run, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > commandCancelWait+time.Second {
+		t.Errorf("Expected Cancel to return after %s, took %s", commandCancelWait, elapsed)
+	}
+	wf, err := commandExecutor{}.Status(run)
+	if err != nil || wf.Status != "RUNNING" {
+		t.Errorf("Expected command to be still stopping, got %v %v", wf, err)
+	}
+}
+
+func envMap(env []string) map[string][]string {
+	m := make(map[string][]string)
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		m[kv[0]] = append(m[kv[0]], kv[1])
+	}
+	return m
+}
+
+func TestCommandEnvProtectedVariables(t *testing.T) {
+	input := map[string]interface{}{
+		"PATH":       "/tmp/evil",
+		"LD_PRELOAD": "/tmp/evil.so",
+		"BASH_ENV":   "/tmp/evil.sh",
+		"ifs":        "/",
+		"lastDate":   "2019-01-01",
+		"window":     map[string]interface{}{"days": 7},
+	}
+	for _, inherit := range []bool{false, true} {
+		target := &CommandTarget{
+			Command:    []string{"/scripts/cleanup.sh"},
+			Env:        map[string]string{"ENV": "/tmp/evil.sh", "DYLD_INSERT_LIBRARIES": "x", "TOKEN": "abc"},
+			InheritEnv: inherit,
+		}
+		env := envMap(commandEnv(target, Trigger{FireTime: time.Now()}, input, "run1"))
+		if len(env["PATH"]) != 1 || env["PATH"][0] != os.Getenv("PATH") {
+			t.Errorf("inheritEnv=%t: expected PATH of schellar, got %v", inherit, env["PATH"])
+		}
+		for _, k := range []string{"LD_PRELOAD", "BASH_ENV", "ifs", "ENV", "DYLD_INSERT_LIBRARIES"} {
+			if _, exists := env[k]; exists && os.Getenv(k) == "" {
+				t.Errorf("inheritEnv=%t: expected %s not to be set", inherit, k)
+			}
+		}
+		if env["lastDate"][0] != "2019-01-01" || env["window"][0] != `{"days":7}` || env["TOKEN"][0] != "abc" || env["runId"][0] != "run1" {
+			t.Errorf("inheritEnv=%t: unexpected environment %v", inherit, env)
+		}
+	}
+}
+
+func TestCommandValidateEnv(t *testing.T) {
+	defer disableCommands()
+	enableCommands(t, "/scripts/cleanup.sh")
+	for _, k := range []string{"PATH", "LD_PRELOAD", "BASH_ENV", "ENV", "IFS", "ld_library_path", "BASH_FUNC_ls%%"} {
+		schedule := commandSchedule("/scripts/cleanup.sh")
+		schedule.Target.Command.Env = map[string]string{k: "x"}
+		if (commandExecutor{}).Validate(&schedule) == nil {
+			t.Errorf("Expected 'env' with %s to be invalid", k)
+		}
+		schedule = commandSchedule("/scripts/cleanup.sh")
+		schedule.WorkflowContext = map[string]interface{}{k: "x"}
+		if (commandExecutor{}).Validate(&schedule) == nil {
+			t.Errorf("Expected workflowContext with %s to be invalid", k)
+		}
+	}
+	schedule := commandSchedule("/scripts/cleanup.sh")
+	schedule.Target.Command.Env = map[string]string{"TOKEN": "abc"}
+	if err := (commandExecutor{}).Validate(&schedule); err != nil {
+		t.Errorf("Expected 'env' to be valid. err=%s", err)
+	}
+}
+
+func TestCommandDir(t *testing.T) {
+	defer func() { commandDirRoot = "" }()
+	commandDirRoot = ""
+	if _, err := commandDir("jobs"); err == nil {
+		t.Errorf("Expected 'dir' to be disabled by default")
+	}
+
+	root, err := ioutil.TempDir("", "schellar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.Mkdir(filepath.Join(root, "jobs"), 0755)
+	os.Symlink(os.TempDir(), filepath.Join(root, "escape"))
+	commandDirRoot = root
+
+	dir, err := commandDir("jobs")
+	if err != nil || filepath.Base(dir) != "jobs" {
+		t.Errorf("Expected dir inside the root to be valid, got %s %v", dir, err)
+	}
+	for _, d := range []string{"../", "/etc", "jobs/../..", "escape", "missing"} {
+		if _, err := commandDir(d); err == nil {
+			t.Errorf("%s: expected dir to be rejected", d)
+		}
+	}
+
+	defer disableCommands()
+	enableCommands(t, "/scripts/cleanup.sh")
+	schedule := commandSchedule("/scripts/cleanup.sh")
+	schedule.Target.Command.Dir = "escape"
+	if (commandExecutor{}).Validate(&schedule) == nil {
+		t.Errorf("Expected dir outside of the root to be invalid")
+	}
+}
@@ -3,159 +3,432 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"gopkg.in/mgo.v2/bson"
 )
 
-func launchWorkflow(scheduleName string) error {
-	logrus.Debugf("startWorkflow scheduleName=%s", scheduleName)
+const latestWorkflowVersion = "latest"
 
-	logrus.Debugf("Loading schedule definitions from DB")
-	var schedule Schedule
-	sc := mongoSession.Copy()
-	defer sc.Close()
-	st := sc.DB(dbName).C("schedules")
+var (
+	errWorkflowDefNotFound = errors.New("workflow definition not found")
 
-	err := st.Find(bson.M{"name": scheduleName}).One(&schedule)
+	defaultHTTPClient = &http.Client{
+		Timeout: time.Second * 10,
+	}
+)
+
+//ConductorClient operations schellar uses from the Conductor API
+type ConductorClient interface {
+	StartWorkflow(request StartWorkflowRequest) (string, error)
+	GetWorkflow(workflowID string) (*Workflow, error)
+	SearchWorkflows(search WorkflowSearch) (*SearchResult, error)
+	//GetWorkflowDef gets a workflow definition. An empty version means the latest one
+	GetWorkflowDef(name string, version string) (*WorkflowDef, error)
+	TerminateWorkflow(workflowID string, reason string) error
+	PauseWorkflow(workflowID string) error
+	ResumeWorkflow(workflowID string) error
+}
+
+//StartWorkflowRequest body of POST /workflow
+type StartWorkflowRequest struct {
+	Name          string                 `json:"name"`
+	Version       int                    `json:"version,omitempty"`
+	Input         map[string]interface{} `json:"input,omitempty"`
+	CorrelationID string                 `json:"correlationId,omitempty"`
+	Priority      int                    `json:"priority,omitempty"`
+	TaskToDomain  map[string]string      `json:"taskToDomain,omitempty"`
+	CreatedBy     string                 `json:"createdBy,omitempty"`
+}
+
+//Workflow instance as returned by GET /workflow/{workflowId}
+type Workflow struct {
+	WorkflowID            string                 `json:"workflowId"`
+	WorkflowType          string                 `json:"workflowType,omitempty"`
+	Version               int                    `json:"version,omitempty"`
+	Status                string                 `json:"status"`
+	CorrelationID         string                 `json:"correlationId,omitempty"`
+	StartTime             int64                  `json:"startTime,omitempty"`
+	EndTime               int64                  `json:"endTime,omitempty"`
+	Input                 map[string]interface{} `json:"input,omitempty"`
+	Output                map[string]interface{} `json:"output,omitempty"`
+	ReasonForIncompletion string                 `json:"reasonForIncompletion,omitempty"`
+}
+
+//StartDate returns the workflow start time, if known
+func (workflow Workflow) StartDate() (time.Time, bool) {
+	if workflow.StartTime <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, workflow.StartTime*int64(time.Millisecond)), true
+}
+
+//WorkflowSummary search result entry as returned by GET /workflow/search
+type WorkflowSummary struct {
+	WorkflowID   string `json:"workflowId"`
+	WorkflowType string `json:"workflowType,omitempty"`
+	Version      int    `json:"version,omitempty"`
+	Status       string `json:"status"`
+	StartTime    string `json:"startTime,omitempty"`
+	EndTime      string `json:"endTime,omitempty"`
+}
+
+//SearchResult response of GET /workflow/search
+type SearchResult struct {
+	TotalHits int               `json:"totalHits"`
+	Results   []WorkflowSummary `json:"results"`
+}
+
+//WorkflowSearch selects workflow instances launched for a schedule. Results are sorted by end time, most recent first
+type WorkflowSearch struct {
+	WorkflowType string
+	ScheduleName string
+	Running      bool
+	Size         int
+}
+
+//WorkflowDef workflow definition as returned by GET /metadata/workflow/{name}
+type WorkflowDef struct {
+	Name             string                 `json:"name"`
+	Description      string                 `json:"description,omitempty"`
+	Version          int                    `json:"version"`
+	InputParameters  []string               `json:"inputParameters,omitempty"`
+	OutputParameters map[string]interface{} `json:"outputParameters,omitempty"`
+}
+
+//resolveWorkflowVersion gets the concrete workflow version to be launched for the schedule.
+//For workflowVersion 'latest', the latest version defined in Conductor is used
+func resolveWorkflowVersion(client ConductorClient, schedule Schedule) (int, error) {
+	if schedule.WorkflowVersion != latestWorkflowVersion {
+		version, err := strconv.Atoi(schedule.WorkflowVersion)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid workflow version '%s'", schedule.WorkflowVersion)
+		}
+		return version, nil
+	}
+	def, err := client.GetWorkflowDef(schedule.WorkflowName, "")
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't resolve latest version of workflow %s. err=%s", schedule.WorkflowName, err)
+	}
+	logrus.Debugf("Schedule %s: Latest version of workflow %s is %d", schedule.Name, schedule.WorkflowName, def.Version)
+	return def.Version, nil
+}
+
+//conductorExecutor launches schedule runs as Conductor workflows
+type conductorExecutor struct{}
+
+func (e conductorExecutor) Validate(schedule *Schedule) error {
+	if schedule.WorkflowName == "" {
+		return errors.New("'workflowName' is required")
+	}
+	if _, err := getConductor(schedule.Conductor); err != nil {
+		return fmt.Errorf("'conductor' is invalid. err=%s", err)
+	}
+	if schedule.WorkflowVersion == "" {
+		schedule.WorkflowVersion = "1"
+	}
+	if _, err := strconv.Atoi(schedule.WorkflowVersion); err != nil && schedule.WorkflowVersion != latestWorkflowVersion {
+		return errors.New("'workflowVersion' must be a number or 'latest'")
+	}
+	return nil
+}
+
+func (e conductorExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	client, err := getConductor(schedule.Conductor)
+	if err != nil {
+		return Run{}, nil, err
+	}
+	version, err := resolveWorkflowVersion(client, schedule)
+	if err != nil {
+		return Run{}, nil, err
+	}
+
+	correlationID := ""
+	if schedule.CorrelationID != "" {
+		correlationID, err = renderTemplate("correlationId", schedule.CorrelationID, newTemplateData(schedule, trigger))
+		if err != nil {
+			return Run{}, nil, fmt.Errorf("Couldn't render correlationId. err=%s", err)
+		}
+	}
+	createdBy := schedule.CreatedBy
+	if createdBy == "" {
+		createdBy = "schellar"
+	}
+
+	request := StartWorkflowRequest{
+		Name:          schedule.WorkflowName,
+		Version:       version,
+		Input:         input,
+		CorrelationID: correlationID,
+		Priority:      schedule.WorkflowPriority,
+		TaskToDomain:  schedule.TaskToDomain,
+		CreatedBy:     createdBy,
+	}
+	logrus.Debugf("Launching Workflow %v", request)
+	workflowID, err := client.StartWorkflow(request)
+	if err != nil {
+		return Run{}, nil, err
+	}
+	logrus.Infof("Schedule %s: Workflow %s launched. workflowId=%s", schedule.Name, schedule.WorkflowName, workflowID)
+
+	run := Run{
+		WorkflowID:      workflowID,
+		WorkflowName:    schedule.WorkflowName,
+		WorkflowVersion: version,
+		Conductor:       schedule.Conductor,
+		CorrelationID:   correlationID,
+	}
+	return run, nil, nil
+}
+
+func (e conductorExecutor) Status(run Run) (*Workflow, error) {
+	client, err := run.conductorClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetWorkflow(run.WorkflowID)
+}
+
+func (e conductorExecutor) Cancel(run Run, reason string) error {
+	client, err := run.conductorClient()
 	if err != nil {
-		logrus.Errorf("Couldn't find schedule %s", scheduleName)
 		return err
 	}
+	return client.TerminateWorkflow(run.WorkflowID, reason)
+}
+
+//httpConductorClient ConductorClient implementation that calls the Conductor REST API
+type httpConductorClient struct {
+	baseURL      string
+	auth         conductorAuth
+	httpClient   *http.Client
+	maxRetries   int
+	retryBackoff time.Duration
+	breaker      *circuitBreaker
+}
 
-	wf := make(map[string]interface{})
-	wf["name"] = schedule.WorkflowName
-	wf["version"] = schedule.WorkflowVersion
-	wf["input"] = schedule.WorkflowContext
-	wf["input"].(map[string]interface{})["scheduleName"] = schedule.Name
-	wfb, _ := json.Marshal(wf)
+func newHTTPConductorClient(baseURL string, auth conductorAuth, httpClient *http.Client) *httpConductorClient {
+	return &httpConductorClient{baseURL: baseURL, auth: auth, httpClient: httpClient, retryBackoff: 500 * time.Millisecond}
+}
 
-	logrus.Debugf("Launching Workflow %s", wf)
-	url := fmt.Sprintf("%s/workflow", conductorURL)
-	resp, data, err := postHTTP(url, wfb)
+func (c *httpConductorClient) StartWorkflow(request StartWorkflowRequest) (string, error) {
+	wfb, _ := json.Marshal(request)
+	resp, data, err := c.call("POST", fmt.Sprintf("%s/workflow", c.baseURL), wfb)
 	if err != nil {
 		logrus.Errorf("Call to Conductor POST /workflow failed. err=%s", err)
-		return err
+		return "", err
 	}
 	if resp.StatusCode != 200 {
 		logrus.Warnf("POST /workflow call status!=200. resp=%v", resp)
-		return fmt.Errorf("Failed to create new workflow instance. status=%d", resp.StatusCode)
+		return "", fmt.Errorf("Failed to create new workflow instance. status=%d", resp.StatusCode)
 	}
-	logrus.Infof("Schedule %s: Workflow %s launched. workflowId=%s", schedule.Name, schedule.WorkflowName, string(data))
-	return nil
+	return string(data), nil
 }
 
-func getWorkflow(name string, version string) (map[string]interface{}, error) {
-	logrus.Debugf("getWorkflow %s", name)
-	resp, data, err := getHTTP(fmt.Sprintf("%s/metadata/workflow/%s?version=%s", conductorURL, name, version))
+func (c *httpConductorClient) GetWorkflowDef(name string, version string) (*WorkflowDef, error) {
+	logrus.Debugf("getWorkflowDef %s", name)
+	url0 := fmt.Sprintf("%s/metadata/workflow/%s", c.baseURL, url.PathEscape(name))
+	if version != "" {
+		url0 = fmt.Sprintf("%s?version=%s", url0, url.QueryEscape(version))
+	}
+	resp, data, err := c.call("GET", url0, nil)
 	if err != nil {
 		return nil, fmt.Errorf("GET /metadata/workflow/name failed. err=%s", err)
 	}
+	if resp.StatusCode == 404 || resp.StatusCode == 204 {
+		return nil, errWorkflowDefNotFound
+	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Couldn't get workflow info. name=%s", name)
+		return nil, fmt.Errorf("Couldn't get workflow info. name=%s. status=%d", name, resp.StatusCode)
 	}
-	var wfdata map[string]interface{}
-	err = json.Unmarshal(data, &wfdata)
+	var wfdef WorkflowDef
+	err = json.Unmarshal(data, &wfdef)
 	if err != nil {
 		logrus.Errorf("Error parsing json. err=%s", err)
 		return nil, err
 	}
-	return wfdata, nil
+	if wfdef.Name == "" {
+		return nil, errWorkflowDefNotFound
+	}
+	return &wfdef, nil
 }
 
-func getWorkflowInstance(workflowID string) (map[string]interface{}, error) {
-	logrus.Debugf("getWorkflowInstance %s", workflowID)
-	resp, data, err := getHTTP(fmt.Sprintf("%s/workflow/%s?includeTasks=false", conductorURL, workflowID))
+func (c *httpConductorClient) GetWorkflow(workflowID string) (*Workflow, error) {
+	logrus.Debugf("getWorkflow %s", workflowID)
+	resp, data, err := c.call("GET", fmt.Sprintf("%s/workflow/%s?includeTasks=false", c.baseURL, workflowID), nil)
 	if err != nil {
-		return nil, fmt.Errorf("GET /workflow/%s?includeTasks=false failed. err=%s", err, workflowID)
+		return nil, fmt.Errorf("GET /workflow/%s?includeTasks=false failed. err=%s", workflowID, err)
 	}
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("Couldn't get workflow info. workflowId=%s. status=%d", workflowID, resp.StatusCode)
 	}
-	var wfdata map[string]interface{}
-	err = json.Unmarshal(data, &wfdata)
+	var wf Workflow
+	err = json.Unmarshal(data, &wf)
 	if err != nil {
 		logrus.Errorf("Error parsing json. err=%s", err)
 		return nil, err
 	}
-	return wfdata, nil
+	return &wf, nil
+}
+
+func (c *httpConductorClient) TerminateWorkflow(workflowID string, reason string) error {
+	logrus.Debugf("terminateWorkflow %s", workflowID)
+	resp, _, err := c.call("DELETE", fmt.Sprintf("%s/workflow/%s?reason=%s", c.baseURL, workflowID, url.QueryEscape(reason)), nil)
+	if err != nil {
+		return fmt.Errorf("DELETE /workflow/%s failed. err=%s", workflowID, err)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return fmt.Errorf("Couldn't terminate workflow. workflowId=%s. status=%d", workflowID, resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *httpConductorClient) PauseWorkflow(workflowID string) error {
+	logrus.Debugf("pauseWorkflow %s", workflowID)
+	resp, _, err := c.call("PUT", fmt.Sprintf("%s/workflow/%s/pause", c.baseURL, workflowID), nil)
+	if err != nil {
+		return fmt.Errorf("PUT /workflow/%s/pause failed. err=%s", workflowID, err)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return fmt.Errorf("Couldn't pause workflow. workflowId=%s. status=%d", workflowID, resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *httpConductorClient) ResumeWorkflow(workflowID string) error {
+	logrus.Debugf("resumeWorkflow %s", workflowID)
+	resp, _, err := c.call("PUT", fmt.Sprintf("%s/workflow/%s/resume", c.baseURL, workflowID), nil)
+	if err != nil {
+		return fmt.Errorf("PUT /workflow/%s/resume failed. err=%s", workflowID, err)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return fmt.Errorf("Couldn't resume workflow. workflowId=%s. status=%d", workflowID, resp.StatusCode)
+	}
+	return nil
 }
 
-func findWorkflows(workflowType string, scheduleName string, running bool) (map[string]interface{}, error) {
-	logrus.Debugf("findWorkflows %s", workflowType)
+func (c *httpConductorClient) SearchWorkflows(search WorkflowSearch) (*SearchResult, error) {
+	logrus.Debugf("searchWorkflows %s", search.WorkflowType)
 	runstr := ""
-	if running {
+	if search.Running {
 		runstr = " AND status=RUNNING"
 	} else {
 		runstr = " AND NOT status=RUNNING"
 	}
-	freeText := fmt.Sprintf("workflowType:%s AND scheduleName=%s%s", workflowType, scheduleName, runstr)
-	sr := fmt.Sprintf("%s/workflow/search?freeText=%s&sort=endTime:DESC&size=5", conductorURL, url.QueryEscape(freeText))
-	// logrus.Debugf("WORKFLOW SEARCH URL=%s", sr)
-	resp, data, err := getHTTP(sr)
+	size := search.Size
+	if size <= 0 {
+		size = 5
+	}
+	freeText := fmt.Sprintf("workflowType:%s AND scheduleName=%s%s", search.WorkflowType, search.ScheduleName, runstr)
+	sr := fmt.Sprintf("%s/workflow/search?freeText=%s&sort=endTime:DESC&size=%d", c.baseURL, url.QueryEscape(freeText), size)
+	resp, data, err := c.call("GET", sr, nil)
 	if err != nil {
 		return nil, fmt.Errorf("GET /workflow/search failed. err=%s", err)
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("GET /workflow/search failed. status=%d. err=%s", resp.StatusCode, err)
+		return nil, fmt.Errorf("GET /workflow/search failed. status=%d", resp.StatusCode)
 	}
-	var wfdata map[string]interface{}
-	err = json.Unmarshal(data, &wfdata)
+	var result SearchResult
+	err = json.Unmarshal(data, &result)
 	if err != nil {
 		logrus.Errorf("Error parsing json. err=%s", err)
 		return nil, err
 	}
-	return wfdata, nil
+	return &result, nil
 }
 
-func postHTTP(url string, data []byte) (http.Response, []byte, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+//call sends a request to Conductor with the configured credentials. If Conductor answers 401 and
+//the credentials are cached tokens, the tokens are refreshed and the request is sent once more.
+//Idempotent requests that fail because Conductor is unreachable or overloaded are retried with backoff
+func (c *httpConductorClient) call(method string, url0 string, data []byte) (http.Response, []byte, error) {
+	if !c.breaker.allow() {
+		return http.Response{}, []byte{}, errCircuitOpen
+	}
+	backoff := c.retryBackoff
+	var resp http.Response
+	var datar []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, datar, err = c.send(method, url0, data)
+		if err == nil && resp.StatusCode == 401 && c.auth != nil && c.auth.Invalidate() {
+			logrus.Debugf("Conductor returned 401. Retrying with refreshed credentials")
+			resp, datar, err = c.send(method, url0, data)
+		}
+		if !isServerFailure(resp, err) || !isIdempotent(method) || attempt >= c.maxRetries {
+			break
+		}
+		logrus.Debugf("%s %s failed. Retrying in %s", method, url0, backoff)
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+	if isServerFailure(resp, err) {
+		c.breaker.failure()
+	} else {
+		c.breaker.success()
+	}
+	return resp, datar, err
+}
+
+func (c *httpConductorClient) send(method string, url0 string, data []byte) (http.Response, []byte, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewBuffer(data)
+	}
+	req, err := http.NewRequest(method, url0, body)
 	if err != nil {
 		logrus.Errorf("HTTP request creation failed. err=%s", err)
 		return http.Response{}, []byte{}, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{
-		Timeout: time.Second * 10,
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	logrus.Debugf("POST request=%v", req)
-	response, err1 := client.Do(req)
-	if err1 != nil {
-		logrus.Errorf("HTTP request invocation failed. err=%s", err1)
-		return http.Response{}, []byte{}, err1
+	if c.auth != nil {
+		err = c.auth.Authorize(req)
+		if err != nil {
+			return http.Response{}, []byte{}, fmt.Errorf("Couldn't authenticate to Conductor. err=%s", err)
+		}
 	}
-
-	logrus.Debugf("Response: %v", response)
-	datar, _ := ioutil.ReadAll(response.Body)
-	logrus.Debugf("Response body: %s", datar)
-	return *response, datar, nil
+	return doHTTP(c.httpClient, req)
 }
 
-func getHTTP(url0 string) (http.Response, []byte, error) {
-	req, err := http.NewRequest("GET", url0, nil)
+func postHTTP(url string, data []byte) (http.Response, []byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		logrus.Errorf("HTTP request creation failed. err=%s", err)
 		return http.Response{}, []byte{}, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	return doHTTP(defaultHTTPClient, req)
+}
 
-	client := &http.Client{
-		Timeout: time.Second * 10,
-	}
-	logrus.Debugf("GET request=%v", req)
+func doHTTP(client *http.Client, req *http.Request) (http.Response, []byte, error) {
+	return sendHTTP(client, req, true)
+}
+
+//doSecretHTTP is like doHTTP, but doesn't log the response body. Used for responses with credentials
+func doSecretHTTP(client *http.Client, req *http.Request) (http.Response, []byte, error) {
+	return sendHTTP(client, req, false)
+}
+
+func sendHTTP(client *http.Client, req *http.Request, logBody bool) (http.Response, []byte, error) {
+	logrus.Debugf("%s request=%s", req.Method, req.URL)
 	response, err1 := client.Do(req)
 	if err1 != nil {
 		logrus.Errorf("HTTP request invocation failed. err=%s", err1)
 		return http.Response{}, []byte{}, err1
 	}
+	defer response.Body.Close()
 
-	// logrus.Debugf("Response: %v", response)
 	datar, _ := ioutil.ReadAll(response.Body)
-	logrus.Debugf("Response body: %s", datar)
+	if logBody {
+		logrus.Debugf("Response body: %s", datar)
+	}
 	return *response, datar, nil
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//fakeConductorClient in-memory ConductorClient used to test the scheduler without a Conductor server.
+//Launched workflows stay RUNNING until FinishWorkflow is called
+type fakeConductorClient struct {
+	mutex     sync.Mutex
+	seq       int
+	workflows map[string]*Workflow
+	defs      map[string][]WorkflowDef
+}
+
+func newFakeConductorClient() *fakeConductorClient {
+	return &fakeConductorClient{
+		workflows: make(map[string]*Workflow),
+		defs:      make(map[string][]WorkflowDef),
+	}
+}
+
+//PutWorkflowDef registers a workflow definition. If no definitions are registered, any workflow can be started and
+//any definition requested exists
+func (c *fakeConductorClient) PutWorkflowDef(def WorkflowDef) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.defs[def.Name] = append(c.defs[def.Name], def)
+}
+
+//FinishWorkflow moves a workflow to a final status with the given output
+func (c *fakeConductorClient) FinishWorkflow(workflowID string, status string, output map[string]interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wf, exists := c.workflows[workflowID]
+	if !exists {
+		return fmt.Errorf("Couldn't find workflow %s", workflowID)
+	}
+	wf.Status = status
+	wf.Output = output
+	wf.EndTime = time.Now().UnixNano() / int64(time.Millisecond)
+	return nil
+}
+
+func (c *fakeConductorClient) StartWorkflow(request StartWorkflowRequest) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.defs) > 0 {
+		if _, exists := c.defs[request.Name]; !exists {
+			return "", fmt.Errorf("Failed to create new workflow instance. status=%d", 404)
+		}
+	}
+	c.seq++
+	workflowID := fmt.Sprintf("fake-%d", c.seq)
+	c.workflows[workflowID] = &Workflow{
+		WorkflowID:    workflowID,
+		WorkflowType:  request.Name,
+		Version:       request.Version,
+		Status:        "RUNNING",
+		CorrelationID: request.CorrelationID,
+		StartTime:     time.Now().UnixNano() / int64(time.Millisecond),
+		Input:         request.Input,
+	}
+	return workflowID, nil
+}
+
+func (c *fakeConductorClient) GetWorkflow(workflowID string) (*Workflow, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wf, exists := c.workflows[workflowID]
+	if !exists {
+		return nil, fmt.Errorf("Couldn't get workflow info. workflowId=%s. status=%d", workflowID, 404)
+	}
+	wfc := *wf
+	return &wfc, nil
+}
+
+func (c *fakeConductorClient) SearchWorkflows(search WorkflowSearch) (*SearchResult, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	matches := make([]*Workflow, 0)
+	for _, wf := range c.workflows {
+		if wf.WorkflowType != search.WorkflowType || wf.Input["scheduleName"] != search.ScheduleName {
+			continue
+		}
+		if (wf.Status == "RUNNING") != search.Running {
+			continue
+		}
+		matches = append(matches, wf)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].EndTime > matches[j].EndTime
+	})
+
+	size := search.Size
+	if size <= 0 {
+		size = 5
+	}
+	result := SearchResult{TotalHits: len(matches), Results: make([]WorkflowSummary, 0)}
+	for i := 0; i < len(matches) && i < size; i++ {
+		result.Results = append(result.Results, WorkflowSummary{
+			WorkflowID:   matches[i].WorkflowID,
+			WorkflowType: matches[i].WorkflowType,
+			Version:      matches[i].Version,
+			Status:       matches[i].Status,
+		})
+	}
+	return &result, nil
+}
+
+func (c *fakeConductorClient) GetWorkflowDef(name string, version string) (*WorkflowDef, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.defs) == 0 {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			v = 1
+		}
+		return &WorkflowDef{Name: name, Version: v}, nil
+	}
+	var found *WorkflowDef
+	for _, def := range c.defs[name] {
+		if version == "" && (found == nil || def.Version > found.Version) || fmt.Sprintf("%d", def.Version) == version {
+			defc := def
+			found = &defc
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	return nil, errWorkflowDefNotFound
+}
+
+func (c *fakeConductorClient) TerminateWorkflow(workflowID string, reason string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wf, exists := c.workflows[workflowID]
+	if !exists {
+		return fmt.Errorf("Couldn't terminate workflow. workflowId=%s. status=%d", workflowID, 404)
+	}
+	if wf.Status == "RUNNING" {
+		wf.Status = "TERMINATED"
+		wf.ReasonForIncompletion = reason
+		wf.EndTime = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	return nil
+}
+
+func (c *fakeConductorClient) PauseWorkflow(workflowID string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wf, exists := c.workflows[workflowID]
+	if !exists {
+		return fmt.Errorf("Couldn't pause workflow. workflowId=%s. status=%d", workflowID, 404)
+	}
+	if wf.Status == "RUNNING" {
+		wf.Status = "PAUSED"
+	}
+	return nil
+}
+
+func (c *fakeConductorClient) ResumeWorkflow(workflowID string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wf, exists := c.workflows[workflowID]
+	if !exists {
+		return fmt.Errorf("Couldn't resume workflow. workflowId=%s. status=%d", workflowID, 404)
+	}
+	if wf.Status == "PAUSED" {
+		wf.Status = "RUNNING"
+	}
+	return nil
+}
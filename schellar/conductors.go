@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultConductorName = "default"
+
+var (
+	conductors = make(map[string]ConductorClient)
+)
+
+//ConductorConfig connection settings of a named Conductor cluster
+type ConductorConfig struct {
+	URL                string              `json:"url"`
+	Auth               ConductorAuthConfig `json:"auth,omitempty"`
+	TimeoutSeconds     int                 `json:"timeoutSeconds,omitempty"`
+	RateLimit          string              `json:"rateLimit,omitempty"`
+	MaxRetries         *int                `json:"maxRetries,omitempty"`
+	BreakerFailures    *int                `json:"breakerFailures,omitempty"`
+	BreakerOpenSeconds int                 `json:"breakerOpenSeconds,omitempty"`
+	CAFile             string              `json:"caFile,omitempty"`
+	CertFile           string              `json:"certFile,omitempty"`
+	KeyFile            string              `json:"keyFile,omitempty"`
+	InsecureSkipVerify bool                `json:"insecureSkipVerify,omitempty"`
+}
+
+//loadConductorsConfig reads named Conductor clusters from a JSON file in the form {"[name]": {"url": "...", ...}}
+func loadConductorsConfig(file string) (map[string]ConductorConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	configs := make(map[string]ConductorConfig)
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JSON. err=%s", err)
+	}
+	return configs, nil
+}
+
+//registerConductor creates the client for a named Conductor cluster and adds it to the registry
+func registerConductor(name string, config ConductorConfig) error {
+	if config.URL == "" {
+		return fmt.Errorf("Conductor '%s': 'url' is required", name)
+	}
+	if _, exists := conductors[name]; exists {
+		return fmt.Errorf("Conductor '%s' is defined more than once", name)
+	}
+	if config.RateLimit != "" {
+		bucket, err := parseRateLimit(config.RateLimit)
+		if err != nil {
+			return fmt.Errorf("Conductor '%s': %s", name, err)
+		}
+		conductorRateLimits[name] = bucket
+	}
+
+	httpClient, err := newConductorHTTPClient(config)
+	if err != nil {
+		return fmt.Errorf("Conductor '%s': %s", name, err)
+	}
+	auth, err := newConductorAuth(config.Auth, config.URL, httpClient)
+	if err != nil {
+		return fmt.Errorf("Conductor '%s': Invalid authentication configuration. err=%s", name, err)
+	}
+	client := newHTTPConductorClient(config.URL, auth, httpClient)
+
+	//undefined means default values. Zero disables retries or the circuit breaker
+	client.maxRetries = 3
+	if config.MaxRetries != nil {
+		if *config.MaxRetries < 0 {
+			return fmt.Errorf("Conductor '%s': 'maxRetries' must be zero or positive", name)
+		}
+		client.maxRetries = *config.MaxRetries
+	}
+	breakerFailures := 5
+	if config.BreakerFailures != nil {
+		if *config.BreakerFailures < 0 {
+			return fmt.Errorf("Conductor '%s': 'breakerFailures' must be zero or positive", name)
+		}
+		breakerFailures = *config.BreakerFailures
+	}
+	breakerOpen := 30 * time.Second
+	if config.BreakerOpenSeconds > 0 {
+		breakerOpen = time.Duration(config.BreakerOpenSeconds) * time.Second
+	}
+	if breakerFailures > 0 {
+		client.breaker = newCircuitBreaker(name, breakerFailures, breakerOpen)
+	}
+
+	conductors[name] = client
+	logrus.Infof("Conductor '%s' registered. url=%s", name, config.URL)
+	return nil
+}
+
+//getConductor returns the client of a named Conductor cluster. An empty name selects the default cluster
+func getConductor(name string) (ConductorClient, error) {
+	if name == "" {
+		name = defaultConductorName
+	}
+	c, exists := conductors[name]
+	if !exists {
+		return nil, fmt.Errorf("Conductor '%s' is not configured", name)
+	}
+	return c, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegisterConductorRetriesAndBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schellar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "conductors.json")
+	err = ioutil.WriteFile(file, []byte(`{
+		"defaults": {"url": "http://conductor1:8080/api"},
+		"disabled": {"url": "http://conductor2:8080/api", "maxRetries": 0, "breakerFailures": 0},
+		"custom": {"url": "http://conductor3:8080/api", "maxRetries": 1, "breakerFailures": 2}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := loadConductorsConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conductors = make(map[string]ConductorClient)
+	for name, config := range configs {
+		err = registerConductor(name, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name       string
+		maxRetries int
+		breaker    bool
+	}{
+		{"defaults", 3, true},
+		{"disabled", 0, false},
+		{"custom", 1, true},
+	}
+	for _, test := range tests {
+		client := conductors[test.name].(*httpConductorClient)
+		if client.maxRetries != test.maxRetries {
+			t.Errorf("%s: expected maxRetries %d, got %d", test.name, test.maxRetries, client.maxRetries)
+		}
+		if (client.breaker != nil) != test.breaker {
+			t.Errorf("%s: expected circuit breaker %t, got %t", test.name, test.breaker, client.breaker != nil)
+		}
+	}
+
+	negative := -1
+	err = registerConductor("negative", ConductorConfig{URL: "http://conductor4:8080/api", MaxRetries: &negative})
+	if err == nil {
+		t.Errorf("Expected negative maxRetries to be invalid")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	maxConcurrentLaunches = 10
+	dispatcher            = newLaunchDispatcher()
+)
+
+//launchRequest is a workflow launch waiting for a free launch slot
+type launchRequest struct {
+	scheduleName string
+	priority     int
+	seq          uint64
+	enqueueTime  time.Time
+	launch       func() error
+	done         chan error
+}
+
+//launchDispatcher limits how many launches are in flight at the same time. Waiting launches
+//are dispatched by schedule priority, then to the schedule that was served least recently, then in arrival order
+type launchDispatcher struct {
+	mutex        sync.Mutex
+	queue        []*launchRequest
+	inFlight     int
+	seq          uint64
+	lastDispatch map[string]time.Time
+}
+
+func newLaunchDispatcher() *launchDispatcher {
+	return &launchDispatcher{
+		queue:        make([]*launchRequest, 0),
+		lastDispatch: make(map[string]time.Time),
+	}
+}
+
+//dispatchLaunch applies rate limits, queues the launch function of a schedule and blocks until it was executed, returning its result.
+//If block is false, a throttled launch returns errLaunchThrottled instead of waiting for the rate limits
+func dispatchLaunch(schedule Schedule, block bool, launch func() error) error {
+	err := acquireLaunchToken(schedule, block)
+	if err != nil {
+		return err
+	}
+	req := &launchRequest{
+		scheduleName: schedule.Name,
+		priority:     schedule.Priority,
+		enqueueTime:  time.Now(),
+		launch:       launch,
+		done:         make(chan error, 1),
+	}
+	dispatcher.enqueue(req)
+	return <-req.done
+}
+
+func (d *launchDispatcher) enqueue(req *launchRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.seq++
+	req.seq = d.seq
+	d.queue = append(d.queue, req)
+	launchQueueGauge.Set(float64(len(d.queue)))
+	if maxConcurrentLaunches > 0 && d.inFlight >= maxConcurrentLaunches {
+		logrus.Debugf("Schedule %s: Launch queued. inFlight=%d queued=%d", req.scheduleName, d.inFlight, len(d.queue))
+	}
+	d.dispatchNext()
+}
+
+//dispatchNext starts queued launches while there are free slots. Must be called with the mutex held
+func (d *launchDispatcher) dispatchNext() {
+	for len(d.queue) > 0 && (maxConcurrentLaunches <= 0 || d.inFlight < maxConcurrentLaunches) {
+		best := 0
+		for i := 1; i < len(d.queue); i++ {
+			if d.before(d.queue[i], d.queue[best]) {
+				best = i
+			}
+		}
+		req := d.queue[best]
+		d.queue = append(d.queue[:best], d.queue[best+1:]...)
+		launchQueueGauge.Set(float64(len(d.queue)))
+
+		d.inFlight++
+		d.lastDispatch[req.scheduleName] = time.Now()
+		launchWaitHistogram.Observe(time.Since(req.enqueueTime).Seconds())
+		go d.run(req)
+	}
+}
+
+func (d *launchDispatcher) run(req *launchRequest) {
+	err := req.launch()
+	d.mutex.Lock()
+	d.inFlight--
+	d.dispatchNext()
+	d.mutex.Unlock()
+	req.done <- err
+}
+
+//before tells whether launch request a should be dispatched before b
+func (d *launchDispatcher) before(a *launchRequest, b *launchRequest) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if a.scheduleName != b.scheduleName {
+		lastA := d.lastDispatch[a.scheduleName]
+		lastB := d.lastDispatch[b.scheduleName]
+		if !lastA.Equal(lastB) {
+			return lastA.Before(lastB)
+		}
+	}
+	return a.seq < b.seq
+}
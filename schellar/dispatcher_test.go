@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLaunchDispatcherBefore(t *testing.T) {
+	d := newLaunchDispatcher()
+	now := time.Now()
+	d.lastDispatch["recent"] = now
+	d.lastDispatch["old"] = now.Add(-time.Minute)
+	tests := []struct {
+		name   string
+		a      launchRequest
+		b      launchRequest
+		before bool
+	}{
+		{"higher priority first", launchRequest{scheduleName: "recent", priority: 2, seq: 2}, launchRequest{scheduleName: "old", priority: 1, seq: 1}, true},
+		{"lower priority last", launchRequest{scheduleName: "old", priority: 1, seq: 1}, launchRequest{scheduleName: "recent", priority: 2, seq: 2}, false},
+		{"least recently served first", launchRequest{scheduleName: "old", seq: 2}, launchRequest{scheduleName: "recent", seq: 1}, true},
+		{"never served first", launchRequest{scheduleName: "new", seq: 2}, launchRequest{scheduleName: "old", seq: 1}, true},
+		{"most recently served last", launchRequest{scheduleName: "recent", seq: 1}, launchRequest{scheduleName: "old", seq: 2}, false},
+		{"same schedule in arrival order", launchRequest{scheduleName: "old", seq: 1}, launchRequest{scheduleName: "old", seq: 2}, true},
+		{"same schedule later arrival last", launchRequest{scheduleName: "old", seq: 2}, launchRequest{scheduleName: "old", seq: 1}, false},
+	}
+	for _, test := range tests {
+		if before := d.before(&test.a, &test.b); before != test.before {
+			t.Errorf("%s: expected before=%t, got %t", test.name, test.before, before)
+		}
+	}
+}
+
+func TestLaunchDispatcherOrder(t *testing.T) {
+	previousMax, previousDispatcher := maxConcurrentLaunches, dispatcher
+	defer func() {
+		maxConcurrentLaunches, dispatcher = previousMax, previousDispatcher
+	}()
+	maxConcurrentLaunches = 1
+	dispatcher = newLaunchDispatcher()
+
+	var mutex sync.Mutex
+	order := make([]string, 0)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	launch := func(schedule Schedule, blocking bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := dispatchLaunch(schedule, true, func() error {
+				mutex.Lock()
+				order = append(order, schedule.Name)
+				mutex.Unlock()
+				if blocking {
+					<-release
+				}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Launch of %s failed. err=%s", schedule.Name, err)
+			}
+		}()
+	}
+	//waits until the launch slot is taken and count launches are queued
+	queued := func(count int) {
+		for i := 0; i < 100; i++ {
+			dispatcher.mutex.Lock()
+			inFlight, n := dispatcher.inFlight, len(dispatcher.queue)
+			dispatcher.mutex.Unlock()
+			if inFlight == 1 && n == count {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d queued launches", count)
+	}
+
+	//the first launch takes the only slot while the others queue up
+	launch(Schedule{Name: "busy"}, true)
+	queued(0)
+	launch(Schedule{Name: "busy"}, false)
+	queued(1)
+	launch(Schedule{Name: "low"}, false)
+	queued(2)
+	launch(Schedule{Name: "high", Priority: 5}, false)
+	queued(3)
+	close(release)
+	wg.Wait()
+
+	expected := []string{"busy", "high", "low", "busy"}
+	for i := range expected {
+		if i >= len(order) || order[i] != expected[i] {
+			t.Fatalf("Expected dispatch order %v, got %v", expected, order)
+		}
+	}
+}
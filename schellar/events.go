@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	notificationWebhookURL string
+)
+
+//Event notification emitted by schellar about schedules
+type Event struct {
+	Type         string                 `json:"type"`
+	ScheduleName string                 `json:"scheduleName"`
+	Message      string                 `json:"message"`
+	Time         time.Time              `json:"time"`
+	Data         map[string]interface{} `json:"data,omitempty"`
+}
+
+//emitEvent logs the event and, if a notification webhook is configured, posts it there in background
+func emitEvent(eventType string, scheduleName string, message string, data map[string]interface{}) {
+	event := Event{
+		Type:         eventType,
+		ScheduleName: scheduleName,
+		Message:      message,
+		Time:         time.Now(),
+		Data:         data,
+	}
+	logrus.WithFields(logrus.Fields{"event": eventType, "schedule": scheduleName}).Info(message)
+	if notificationWebhookURL == "" {
+		return
+	}
+	go func() {
+		eb, _ := json.Marshal(event)
+		resp, _, err := postHTTP(notificationWebhookURL, eb)
+		if err != nil {
+			logrus.Warnf("Couldn't send event %s to notification webhook. err=%s", eventType, err)
+			return
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			logrus.Warnf("Notification webhook returned status %d for event %s", resp.StatusCode, eventType)
+		}
+	}()
+}
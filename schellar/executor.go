@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	conductorTarget = "conductor"
+	//redactedSecret replaces secrets in API responses and logs
+	redactedSecret = "REDACTED"
+	//maxRecordedBytes limits the size of responses and outputs recorded in run results
+	maxRecordedBytes = 64 * 1024
+)
+
+//Executor runs the work of schedules on an execution backend (target type). The state of runs is
+//reported as a Workflow, using Conductor workflow statuses (RUNNING, COMPLETED, FAILED, TERMINATED...)
+type Executor interface {
+	//Validate checks the target configuration of the schedule, applying defaults
+	Validate(schedule *Schedule) error
+	//Launch starts a new run for the schedule with the given input. Executors that finish the run
+	//right away (synchronous targets) return its final state, otherwise nil
+	Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error)
+	//Status gets the current state of a run launched by this executor
+	Status(run Run) (*Workflow, error)
+	//Cancel stops a run that is still running
+	Cancel(run Run, reason string) error
+}
+
+//Target where the runs of a schedule are executed. Defaults to Conductor
+type Target struct {
+	Type     string          `json:"type" bson:"type"`
+	Webhook  *WebhookTarget  `json:"webhook,omitempty" bson:"webhook,omitempty"`
+	Kafka    *KafkaTarget    `json:"kafka,omitempty" bson:"kafka,omitempty"`
+	AMQP     *AMQPTarget     `json:"amqp,omitempty" bson:"amqp,omitempty"`
+	NATS     *NATSTarget     `json:"nats,omitempty" bson:"nats,omitempty"`
+	Command  *CommandTarget  `json:"command,omitempty" bson:"command,omitempty"`
+	Temporal *TemporalTarget `json:"temporal,omitempty" bson:"temporal,omitempty"`
+	GRPC     *GRPCTarget     `json:"grpc,omitempty" bson:"grpc,omitempty"`
+	Redis    *RedisTarget    `json:"redis,omitempty" bson:"redis,omitempty"`
+}
+
+var (
+	executors = map[string]Executor{
+		conductorTarget: conductorExecutor{},
+		webhookTarget:   webhookExecutor{},
+		kafkaTarget:     kafkaExecutor{},
+		amqpTarget:      amqpExecutor{},
+		natsTarget:      natsExecutor{},
+		commandTarget:   commandExecutor{},
+		temporalTarget:  temporalExecutor{},
+		grpcTarget:      grpcExecutor{},
+		redisTarget:     redisExecutor{},
+	}
+
+	//final states of runs finished synchronously by their executors, kept until they are processed by checkScheduleRuns
+	finishedRunsMutex sync.Mutex
+	finishedRuns      = make(map[string]*Workflow)
+)
+
+//targetType the executor type of the schedule
+func (schedule *Schedule) targetType() string {
+	if schedule.Target == nil || schedule.Target.Type == "" {
+		return conductorTarget
+	}
+	return schedule.Target.Type
+}
+
+//redacted returns a copy of the schedule without the secrets of its target, to be shown in API responses and logs
+func (schedule Schedule) redacted() Schedule {
+	if schedule.Target != nil {
+		schedule.Target = schedule.Target.redacted()
+	}
+	return schedule
+}
+
+//redacted returns a copy of the target with secrets and URL credentials replaced by redactedSecret
+func (target Target) redacted() *Target {
+	if target.Webhook != nil {
+		webhook := *target.Webhook
+		webhook.URL = redactURL(webhook.URL)
+		webhook.HMACSecret = redactSecret(webhook.HMACSecret)
+		target.Webhook = &webhook
+	}
+	if target.AMQP != nil {
+		amqp := *target.AMQP
+		amqp.URL = redactURL(amqp.URL)
+		target.AMQP = &amqp
+	}
+	if target.NATS != nil {
+		nats := *target.NATS
+		nats.URL = redactURL(nats.URL)
+		target.NATS = &nats
+	}
+	if target.Redis != nil {
+		redis := *target.Redis
+		redis.URL = redactURL(redis.URL)
+		target.Redis = &redis
+	}
+	return &target
+}
+
+//keepSecrets puts back the stored secrets of a target that were sent back redacted, like when a schedule
+//read from the API is updated
+func (target *Target) keepSecrets(stored *Target) {
+	if stored == nil {
+		return
+	}
+	if target.Webhook != nil && stored.Webhook != nil {
+		target.Webhook.URL = keepSecret(target.Webhook.URL, stored.Webhook.URL, redactURL)
+		target.Webhook.HMACSecret = keepSecret(target.Webhook.HMACSecret, stored.Webhook.HMACSecret, redactSecret)
+	}
+	if target.AMQP != nil && stored.AMQP != nil {
+		target.AMQP.URL = keepSecret(target.AMQP.URL, stored.AMQP.URL, redactURL)
+	}
+	if target.NATS != nil && stored.NATS != nil {
+		target.NATS.URL = keepSecret(target.NATS.URL, stored.NATS.URL, redactURL)
+	}
+	if target.Redis != nil && stored.Redis != nil {
+		target.Redis.URL = keepSecret(target.Redis.URL, stored.Redis.URL, redactURL)
+	}
+}
+
+func keepSecret(value string, stored string, redact func(string) string) string {
+	if value != stored && value == redact(stored) {
+		return stored
+	}
+	return value
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+//redactURL replaces the user info of URLs, like 'redis://:password@redis:6379', by redactedSecret.
+//The rest of the URL is kept as is, so that templates in it are shown unchanged and URLs that don't parse are redacted too
+func redactURL(value string) string {
+	scheme := strings.Index(value, "://")
+	if scheme < 0 {
+		return value
+	}
+	rest := value[scheme+3:]
+	authority := rest
+	if end := strings.IndexAny(rest, "/?#"); end >= 0 {
+		authority = rest[:end]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return value
+	}
+	return value[:scheme+3] + redactedSecret + rest[at:]
+}
+
+//getExecutor returns the executor of a target type. Empty means Conductor
+func getExecutor(targetType string) (Executor, error) {
+	if targetType == "" {
+		targetType = conductorTarget
+	}
+	executor, exists := executors[targetType]
+	if !exists {
+		return nil, fmt.Errorf("Unknown target type '%s'", targetType)
+	}
+	return executor, nil
+}
+
+//targetAvailable tells whether launches for the schedule should be attempted now
+func targetAvailable(schedule Schedule) bool {
+	if schedule.targetType() != conductorTarget {
+		return true
+	}
+	return conductorAvailable(schedule.Conductor)
+}
+
+//launchRun starts a new run for the schedule on its target and records it.
+//Retries of failed runs receive retryOf and retryAttempt as input.
+//If the run finished right away, its final state is returned too
+func launchRun(scheduleName string, trigger Trigger) (Run, *Workflow, error) {
+	logrus.Debugf("launchRun scheduleName=%s", scheduleName)
+
+	logrus.Debugf("Loading schedule definitions from DB")
+	var schedule Schedule
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	st := sc.DB(dbName).C("schedules")
+
+	err := st.Find(bson.M{"name": scheduleName}).One(&schedule)
+	if err != nil {
+		logrus.Errorf("Couldn't find schedule %s", scheduleName)
+		return Run{}, nil, err
+	}
+
+	executor, err := getExecutor(schedule.targetType())
+	if err != nil {
+		return Run{}, nil, err
+	}
+
+	input := make(map[string]interface{})
+	for k, v := range schedule.WorkflowContext {
+		input[k] = v
+	}
+	if trigger.RetryOf != "" {
+		input["retryOf"] = trigger.RetryOf
+		input["retryAttempt"] = trigger.RetryAttempt
+	}
+	input["scheduleName"] = schedule.Name
+	input, err = renderInput(schedule, trigger, input)
+	if err != nil {
+		return Run{}, nil, err
+	}
+
+	run, state, err := executor.Launch(schedule, trigger, input)
+	if err != nil {
+		return Run{}, nil, err
+	}
+	run.ScheduleName = schedule.Name
+	if run.WorkflowName == "" {
+		run.WorkflowName = schedule.WorkflowName
+	}
+	if schedule.targetType() != conductorTarget {
+		run.Target = schedule.targetType()
+	}
+	run.Status = "RUNNING"
+	run.RetryOf = trigger.RetryOf
+	run.RetryAttempt = trigger.RetryAttempt
+	run.FireTime = trigger.FireTime
+	run.StartDate = time.Now()
+	if state != nil {
+		state.WorkflowID = run.WorkflowID
+		finishedRunsMutex.Lock()
+		finishedRuns[run.WorkflowID] = state
+		finishedRunsMutex.Unlock()
+	}
+
+	err = recordRun(run)
+	if err != nil {
+		logrus.Errorf("Couldn't record run %s of schedule %s. Conductor runs will be recovered by searching Conductor. err=%s", run.WorkflowID, schedule.Name, err)
+	}
+	return run, state, nil
+}
+
+//renderInput renders the workflowContext templates defined in the schedule in the input of a run
+func renderInput(schedule Schedule, trigger Trigger, input map[string]interface{}) (map[string]interface{}, error) {
+	if len(schedule.ContextTemplates) == 0 {
+		return input, nil
+	}
+	data := newTemplateData(schedule, trigger)
+	var err error
+	data.PreviousRun, err = lastRun(schedule.Name, "")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get previous run. err=%s", err)
+	}
+	data.LastCompletedRun, err = lastRun(schedule.Name, "COMPLETED")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get last completed run. err=%s", err)
+	}
+	return renderContextTemplates(input, schedule.ContextTemplates, data)
+}
+
+//finishedRunState returns the final state of a run that finished synchronously and wasn't processed yet
+func finishedRunState(workflowID string) (*Workflow, bool) {
+	finishedRunsMutex.Lock()
+	defer finishedRunsMutex.Unlock()
+	wf, exists := finishedRuns[workflowID]
+	return wf, exists
+}
+
+func forgetFinishedRun(workflowID string) {
+	finishedRunsMutex.Lock()
+	defer finishedRunsMutex.Unlock()
+	delete(finishedRuns, workflowID)
+}
+
+//newRunID creates ids for runs of targets that don't have their own execution ids
+func newRunID() string {
+	return bson.NewObjectId().Hex()
+}
+
+//messagePayload the content of messages published by message targets: the input plus trigger metadata
+func messagePayload(trigger Trigger, input map[string]interface{}, runID string) map[string]interface{} {
+	payload := make(map[string]interface{})
+	for k, v := range input {
+		payload[k] = v
+	}
+	payload["fireTime"] = trigger.FireTime.Format(time.RFC3339)
+	payload["runId"] = runID
+	return payload
+}
+
+//messageRunState the final state of a run of message targets. The run is COMPLETED if the message was
+//delivered. Replies are recorded in the run result and, if they are JSON objects, are the run output
+func messageRunState(run *Run, startTime time.Time, reply []byte, err error) *Workflow {
+	state := &Workflow{
+		StartTime: startTime.UnixNano() / int64(time.Millisecond),
+		EndTime:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err != nil {
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = err.Error()
+		return state
+	}
+	state.Status = "COMPLETED"
+	if reply != nil {
+		var output map[string]interface{}
+		if json.Unmarshal(reply, &output) == nil {
+			state.Output = output
+			run.Result["reply"] = output
+		} else {
+			run.Result["reply"] = truncate(string(reply), maxRecordedBytes)
+		}
+	}
+	return state
+}
+
+//lostRunState is the state of a synchronous run whose result is unknown because schellar
+//stopped between launching it and recording its result
+func lostRunState(run Run) *Workflow {
+	return &Workflow{
+		WorkflowID:            run.WorkflowID,
+		Status:                "FAILED",
+		ReasonForIncompletion: "Run result was lost. Schellar stopped before recording it",
+		StartTime:             run.StartDate.UnixNano() / int64(time.Millisecond),
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const grpcTarget = "grpc"
+
+//GRPCTarget invokes a unary gRPC method on each trigger
+type GRPCTarget struct {
+	Address string `json:"address" bson:"address"`
+	//Method fully qualified method name. Example: 'mypackage.MyService/Cleanup'
+	Method string `json:"method" bson:"method"`
+	//DescriptorSetFile file with a FileDescriptorSet (protoc --include_imports --descriptor_set_out) describing the method,
+	//relative to the 'grpc-descriptor-dir'. If empty, the method is resolved with server reflection
+	DescriptorSetFile string `json:"descriptorSetFile,omitempty" bson:"descriptorSetFile,omitempty"`
+	//Request Go template rendering the JSON request, with the same values as webhook bodies. Defaults to the input,
+	//ignoring fields that are not in the request message
+	Request            string            `json:"request,omitempty" bson:"request,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty" bson:"metadata,omitempty"`
+	TLS                bool              `json:"tls,omitempty" bson:"tls,omitempty"`
+	InsecureSkipVerify bool              `json:"insecureSkipVerify,omitempty" bson:"insecureSkipVerify,omitempty"`
+	TimeoutSeconds     int               `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+}
+
+var (
+	//grpcDescriptorDir directory with the descriptor set files targets can use. Descriptor set files are disabled if empty
+	grpcDescriptorDir = ""
+
+	grpcMutex sync.Mutex
+	//grpcConns connections by address and TLS settings. They reconnect by themselves when needed
+	grpcConns = make(map[string]*grpc.ClientConn)
+	//grpcMethods resolved method descriptors by address, descriptor set file and method
+	grpcMethods = make(map[string]protoreflect.MethodDescriptor)
+)
+
+//grpcExecutor invokes gRPC methods. Runs finish synchronously with the response
+type grpcExecutor struct{}
+
+func (e grpcExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.GRPC
+	if target == nil || target.Address == "" {
+		return errors.New("'target.grpc.address' is required")
+	}
+	if _, _, err := splitGRPCMethod(target.Method); err != nil {
+		return err
+	}
+	if target.DescriptorSetFile != "" {
+		if _, err := grpcDescriptorPath(target.DescriptorSetFile); err != nil {
+			return fmt.Errorf("Invalid 'target.grpc.descriptorSetFile'. err=%s", err)
+		}
+	}
+	if target.Request != "" {
+		if _, err := parseTemplate("request", target.Request); err != nil {
+			return fmt.Errorf("'target.grpc.request' is not a valid template. err=%s", err)
+		}
+	}
+	if target.TimeoutSeconds < 0 {
+		return errors.New("'target.grpc.timeoutSeconds' must be positive")
+	}
+	if target.TimeoutSeconds == 0 {
+		target.TimeoutSeconds = 30
+	}
+	return nil
+}
+
+func (e grpcExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.GRPC
+	run := Run{WorkflowID: newRunID(), Result: map[string]interface{}{"method": target.Method}}
+
+	var request []byte
+	var err error
+	if target.Request != "" {
+		data := newTemplateData(schedule, trigger)
+		data.Input = input
+		r, err := renderTemplate("request", target.Request, data)
+		if err != nil {
+			return Run{}, nil, fmt.Errorf("Couldn't render gRPC request. err=%s", err)
+		}
+		request = []byte(r)
+	} else {
+		request, err = json.Marshal(input)
+		if err != nil {
+			return Run{}, nil, err
+		}
+	}
+
+	startTime := time.Now()
+	response, err := invokeGRPC(target, request)
+	state := &Workflow{
+		StartTime: startTime.UnixNano() / int64(time.Millisecond),
+		EndTime:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err != nil {
+		logrus.Infof("Schedule %s: gRPC call %s failed. err=%s", schedule.Name, target.Method, err)
+		if st, ok := status.FromError(err); ok {
+			run.Result["code"] = st.Code().String()
+		}
+		run.Result["error"] = err.Error()
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = err.Error()
+		return run, state, nil
+	}
+	logrus.Infof("Schedule %s: gRPC method %s called. runId=%s", schedule.Name, target.Method, run.WorkflowID)
+
+	run.Result["code"] = "OK"
+	var output map[string]interface{}
+	err = json.Unmarshal(response, &output)
+	if err != nil {
+		//the method was called. Only its response couldn't be read
+		reason := fmt.Sprintf("Couldn't read gRPC response. err=%s", err)
+		run.Result["error"] = reason
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = reason
+		return run, state, nil
+	}
+	run.Result["response"] = output
+	state.Status = "COMPLETED"
+	state.Output = output
+	return run, state, nil
+}
+
+func (e grpcExecutor) Status(run Run) (*Workflow, error) {
+	return lostRunState(run), nil
+}
+
+func (e grpcExecutor) Cancel(run Run, reason string) error {
+	return fmt.Errorf("gRPC calls can't be cancelled")
+}
+
+//splitGRPCMethod splits a method name like 'pkg.Service/Method' or 'pkg.Service.Method' into service and method names
+func splitGRPCMethod(fullMethod string) (string, string, error) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	i := strings.LastIndexAny(fullMethod, "/.")
+	if i <= 0 || i == len(fullMethod)-1 {
+		return "", "", fmt.Errorf("'target.grpc.method' must be a fully qualified method like 'mypackage.MyService/MyMethod'")
+	}
+	return fullMethod[:i], fullMethod[i+1:], nil
+}
+
+//invokeGRPC calls the target method with a JSON request, returning the JSON response
+func invokeGRPC(target *GRPCTarget, request []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(target.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	conn, err := grpcConn(target)
+	if err != nil {
+		return nil, err
+	}
+	method, err := grpcMethod(ctx, conn, target)
+	if err != nil {
+		return nil, err
+	}
+	req, err := grpcRequest(method, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := dynamicpb.NewMessage(method.Output())
+	if len(target.Metadata) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(target.Metadata))
+	}
+	err = conn.Invoke(ctx, fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name()), req, resp)
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			//the server may have changed. Resolve the method again on the next call
+			forgetGRPCMethod(target)
+		}
+		return nil, err
+	}
+	return grpcResponseJSON(resp)
+}
+
+//grpcConn returns the connection to the address of the target, creating it on first use
+func grpcConn(target *GRPCTarget) (*grpc.ClientConn, error) {
+	grpcMutex.Lock()
+	defer grpcMutex.Unlock()
+	key := fmt.Sprintf("%s|%t|%t", target.Address, target.TLS, target.InsecureSkipVerify)
+	conn, exists := grpcConns[key]
+	if exists {
+		return conn, nil
+	}
+	creds := insecure.NewCredentials()
+	if target.TLS {
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: target.InsecureSkipVerify})
+	}
+	conn, err := grpc.Dial(target.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't connect to %s. err=%s", target.Address, err)
+	}
+	grpcConns[key] = conn
+	return conn, nil
+}
+
+func grpcMethodKey(target *GRPCTarget) string {
+	return fmt.Sprintf("%s|%s|%s", target.Address, target.DescriptorSetFile, target.Method)
+}
+
+func forgetGRPCMethod(target *GRPCTarget) {
+	grpcMutex.Lock()
+	defer grpcMutex.Unlock()
+	delete(grpcMethods, grpcMethodKey(target))
+}
+
+//grpcMethod returns the descriptor of the target method, resolving it on first use from the descriptor set file or with server reflection
+func grpcMethod(ctx context.Context, conn *grpc.ClientConn, target *GRPCTarget) (protoreflect.MethodDescriptor, error) {
+	key := grpcMethodKey(target)
+	grpcMutex.Lock()
+	method, exists := grpcMethods[key]
+	grpcMutex.Unlock()
+	if exists {
+		return method, nil
+	}
+
+	serviceName, methodName, _ := splitGRPCMethod(target.Method)
+	var files *protoregistry.Files
+	var err error
+	if target.DescriptorSetFile != "" {
+		files, err = descriptorSetFiles(target.DescriptorSetFile)
+	} else {
+		files, err = reflectionFiles(ctx, conn, serviceName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, fmt.Errorf("Service %s not found. err=%s", serviceName, err)
+	}
+	service, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", serviceName)
+	}
+	method = service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, fmt.Errorf("Method %s not found in service %s", methodName, serviceName)
+	}
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil, fmt.Errorf("Method %s is not unary", target.Method)
+	}
+
+	grpcMutex.Lock()
+	grpcMethods[key] = method
+	grpcMutex.Unlock()
+	return method, nil
+}
+
+//grpcRequest builds the request message of a method from JSON, ignoring unknown fields
+func grpcRequest(method protoreflect.MethodDescriptor, request []byte) (*dynamicpb.Message, error) {
+	req := dynamicpb.NewMessage(method.Input())
+	err := protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(request, req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't build request %s from JSON. err=%s", method.Input().FullName(), err)
+	}
+	return req, nil
+}
+
+//grpcResponseJSON converts a response message to JSON, including fields with default values
+func grpcResponseJSON(resp proto.Message) ([]byte, error) {
+	return protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(resp)
+}
+
+//grpcDescriptorPath resolves a descriptor set file inside the 'grpc-descriptor-dir'
+func grpcDescriptorPath(file string) (string, error) {
+	if grpcDescriptorDir == "" {
+		return "", errors.New("Descriptor set files are disabled. Configure 'grpc-descriptor-dir' to use them")
+	}
+	if !filepath.IsLocal(file) {
+		return "", fmt.Errorf("'%s' must be a relative path inside 'grpc-descriptor-dir'", file)
+	}
+	return filepath.Join(grpcDescriptorDir, file), nil
+}
+
+//descriptorSetFiles loads the file descriptors of a FileDescriptorSet file in the 'grpc-descriptor-dir'
+func descriptorSetFiles(file string) (*protoregistry.Files, error) {
+	path, err := grpcDescriptorPath(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read descriptor set %s. err=%s", file, err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	err = proto.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid descriptor set %s. err=%s", file, err)
+	}
+	return protodesc.NewFiles(&set)
+}
+
+//reflectionFiles gets the file descriptors of a service and its dependencies with server reflection
+func reflectionFiles(ctx context.Context, conn *grpc.ClientConn, serviceName string) (*protoregistry.Files, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Server reflection failed. err=%s", err)
+	}
+	defer stream.CloseSend()
+
+	fds := make(map[string]*descriptorpb.FileDescriptorProto)
+	request := &rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: serviceName}}
+	pending := []*rpb.ServerReflectionRequest{request}
+	for len(pending) > 0 {
+		err := stream.Send(pending[0])
+		if err != nil {
+			return nil, fmt.Errorf("Server reflection failed. err=%s", err)
+		}
+		pending = pending[1:]
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, fmt.Errorf("Server reflection failed. err=%s", err)
+		}
+		if errResp := resp.GetErrorResponse(); errResp != nil {
+			return nil, fmt.Errorf("Server reflection failed. err=%s", errResp.GetErrorMessage())
+		}
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			var fd descriptorpb.FileDescriptorProto
+			err := proto.Unmarshal(b, &fd)
+			if err != nil {
+				return nil, err
+			}
+			fds[fd.GetName()] = &fd
+		}
+		//request dependencies that were not sent yet. Well known types may be omitted by the server, so they are
+		//taken from the types linked in schellar
+		for name, fd := range fds {
+			for _, dep := range fd.GetDependency() {
+				if _, exists := fds[dep]; exists || requested(pending, dep) {
+					continue
+				}
+				if gfd, err := protoregistry.GlobalFiles.FindFileByPath(dep); err == nil {
+					addLinkedFile(fds, gfd)
+					continue
+				}
+				logrus.Debugf("Requesting %s, imported by %s, with server reflection", dep, name)
+				pending = append(pending, &rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep}})
+			}
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range fds {
+		set.File = append(set.File, fd)
+	}
+	return protodesc.NewFiles(set)
+}
+
+func requested(pending []*rpb.ServerReflectionRequest, file string) bool {
+	for _, r := range pending {
+		if r.GetFileByFilename() == file {
+			return true
+		}
+	}
+	return false
+}
+
+//addLinkedFile adds a file descriptor linked in schellar and its imports
+func addLinkedFile(fds map[string]*descriptorpb.FileDescriptorProto, fd protoreflect.FileDescriptor) {
+	if _, exists := fds[fd.Path()]; exists {
+		return
+	}
+	fds[fd.Path()] = protodesc.ToFileDescriptorProto(fd)
+	imports := fd.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		addLinkedFile(fds, imports.Get(i).FileDescriptor)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestSplitGRPCMethod(t *testing.T) {
+	tests := []struct {
+		method  string
+		service string
+		name    string
+	}{
+		{"grpc.health.v1.Health/Check", "grpc.health.v1.Health", "Check"},
+		{"/grpc.health.v1.Health/Check", "grpc.health.v1.Health", "Check"},
+		{"grpc.health.v1.Health.Check", "grpc.health.v1.Health", "Check"},
+		{"Health/Check", "Health", "Check"},
+	}
+	for _, test := range tests {
+		service, name, err := splitGRPCMethod(test.method)
+		if err != nil || service != test.service || name != test.name {
+			t.Errorf("%s: expected %s %s, got %s %s %v", test.method, test.service, test.name, service, name, err)
+		}
+	}
+	for _, method := range []string{"", "Check", "Health/", "/Check"} {
+		if _, _, err := splitGRPCMethod(method); err == nil {
+			t.Errorf("%s: expected invalid method", method)
+		}
+	}
+}
+
+func healthCheckMethod() protoreflect.MethodDescriptor {
+	return healthpb.File_grpc_health_v1_health_proto.Services().ByName("Health").Methods().ByName("Check")
+}
+
+func TestGRPCRequestAndResponseJSON(t *testing.T) {
+	method := healthCheckMethod()
+	req, err := grpcRequest(method, []byte(`{"service": "jobs", "scheduleName": "s1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := req.Get(method.Input().Fields().ByName("service")).String(); v != "jobs" {
+		t.Errorf("Expected service 'jobs', got '%s'", v)
+	}
+	_, err = grpcRequest(method, []byte(`{"service": 1}`))
+	if err == nil {
+		t.Errorf("Expected request with invalid field type to fail")
+	}
+
+	resp := dynamicpb.NewMessage(method.Output())
+	b, err := grpcResponseJSON(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"status":"UNKNOWN"}` {
+		t.Errorf("Expected default values in response, got %s", b)
+	}
+	status := method.Output().Fields().ByName("status")
+	resp.Set(status, protoreflect.ValueOfEnum(protoreflect.EnumNumber(healthpb.HealthCheckResponse_SERVING)))
+	b, _ = grpcResponseJSON(resp)
+	if string(b) != `{"status":"SERVING"}` {
+		t.Errorf("Unexpected response JSON %s", b)
+	}
+}
+
+func TestGRPCDescriptorPath(t *testing.T) {
+	defer func() { grpcDescriptorDir = "" }()
+	grpcDescriptorDir = ""
+	if _, err := grpcDescriptorPath("jobs.pb"); err == nil {
+		t.Errorf("Expected descriptor set files to be disabled by default")
+	}
+	grpcDescriptorDir = "/descriptors"
+	path, err := grpcDescriptorPath("jobs/jobs.pb")
+	if err != nil || path != "/descriptors/jobs/jobs.pb" {
+		t.Errorf("Unexpected descriptor path %s %v", path, err)
+	}
+	for _, file := range []string{"../etc/passwd", "/etc/passwd", "jobs/../../x.pb"} {
+		if _, err := grpcDescriptorPath(file); err == nil {
+			t.Errorf("%s: expected path outside of the descriptor dir to be rejected", file)
+		}
+	}
+}
+
+func TestGRPCLaunch(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("jobs", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	schedule := Schedule{
+		Name:   "s1",
+		Target: &Target{Type: grpcTarget, GRPC: &GRPCTarget{Address: listener.Addr().String(), Method: "grpc.health.v1.Health/Check", TimeoutSeconds: 5}},
+	}
+	input := map[string]interface{}{"service": "jobs"}
+	for i := 0; i < 2; i++ {
+		run, state, err := grpcExecutor{}.Launch(schedule, Trigger{FireTime: time.Now()}, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Status != "COMPLETED" || state.Output["status"] != "SERVING" || run.Result["code"] != "OK" {
+			t.Fatalf("Unexpected run state %+v %v", state, run.Result)
+		}
+	}
+	grpcMutex.Lock()
+	_, cached := grpcMethods[grpcMethodKey(schedule.Target.GRPC)]
+	grpcMutex.Unlock()
+	if !cached {
+		t.Errorf("Expected resolved method to be cached")
+	}
+
+	input["service"] = "other"
+	_, state, err := grpcExecutor{}.Launch(schedule, Trigger{FireTime: time.Now()}, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != "FAILED" {
+		t.Errorf("Expected run FAILED for an unknown service, got %s", state.Status)
+	}
+}
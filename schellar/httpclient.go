@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errCircuitOpen = errors.New("Conductor circuit breaker is open")
+)
+
+//newConductorHTTPClient creates the HTTP client shared by all calls to a Conductor cluster, with connection pooling and TLS settings
+func newConductorHTTPClient(config ConductorConfig) (*http.Client, error) {
+	timeout := 10 * time.Second
+	if config.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		ca, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA file %s. err=%s", config.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load client certificate. err=%s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 20,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+//isIdempotent tells whether a request can be safely sent again after a failure
+func isIdempotent(method string) bool {
+	return method == "GET" || method == "PUT" || method == "DELETE" || method == "HEAD"
+}
+
+//isServerFailure tells whether a call result means Conductor is not working properly
+func isServerFailure(resp http.Response, err error) bool {
+	return err != nil || resp.StatusCode == 502 || resp.StatusCode == 503 || resp.StatusCode == 504
+}
+
+//circuitBreaker stops calls to Conductor after consecutive failures. After openDuration, one call
+//is let through to check if Conductor is back (half open). If it succeeds, calls are allowed again
+type circuitBreaker struct {
+	name         string
+	maxFailures  int
+	openDuration time.Duration
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(name string, maxFailures int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, maxFailures: maxFailures, openDuration: openDuration}
+}
+
+//allow tells whether a call can be made now
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failures < b.maxFailures {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+//available tells whether calls are currently allowed, without reserving a half open probe
+func (b *circuitBreaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.failures < b.maxFailures || (!b.probing && !time.Now().Before(b.openUntil))
+}
+
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failures >= b.maxFailures {
+		logrus.Infof("Conductor '%s' is back. Closing circuit breaker", b.name)
+		circuitOpenGauge.WithLabelValues(b.name).Set(0)
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.maxFailures {
+		if b.failures == b.maxFailures {
+			logrus.Warnf("Conductor '%s' failed %d consecutive calls. Opening circuit breaker for %s", b.name, b.failures, b.openDuration)
+			emitEvent("CIRCUIT_OPEN", "", fmt.Sprintf("Conductor '%s' is unavailable. Launches are paused", b.name), map[string]interface{}{"conductor": b.name})
+		}
+		circuitOpenGauge.WithLabelValues(b.name).Set(1)
+		b.openUntil = time.Now().Add(b.openDuration)
+	}
+}
+
+//conductorAvailable tells whether launches to the named Conductor cluster should be attempted now
+func conductorAvailable(name string) bool {
+	client, err := getConductor(name)
+	if err != nil {
+		return false
+	}
+	c, ok := client.(*httpConductorClient)
+	if !ok {
+		return true
+	}
+	return c.breaker.available()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+const kafkaTarget = "kafka"
+
+//KafkaTarget publishes a message to a Kafka topic on each trigger
+type KafkaTarget struct {
+	//Brokers addresses of the Kafka brokers
+	Brokers []string `json:"brokers" bson:"brokers"`
+	Topic   string   `json:"topic" bson:"topic"`
+	//Key Go template with the same values as webhook bodies. Messages without key are spread among partitions
+	Key     string            `json:"key,omitempty" bson:"key,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+	//RequiredAcks 'all' (default) or 'one'
+	RequiredAcks   string `json:"requiredAcks,omitempty" bson:"requiredAcks,omitempty"`
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+}
+
+//kafkaMessage a message to be published
+type kafkaMessage struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+//kafkaProducer publishes messages, returning after they were acknowledged by the brokers
+type kafkaProducer interface {
+	Produce(target *KafkaTarget, message kafkaMessage) error
+}
+
+var (
+	kafkaProducerInstance kafkaProducer = newKafkaGoProducer()
+)
+
+//kafkaExecutor publishes messages to Kafka. Runs finish synchronously when the message is acknowledged
+type kafkaExecutor struct{}
+
+func (e kafkaExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.Kafka
+	if target == nil || len(target.Brokers) == 0 {
+		return errors.New("'target.kafka.brokers' is required")
+	}
+	if target.Topic == "" {
+		return errors.New("'target.kafka.topic' is required")
+	}
+	if target.Key != "" {
+		if _, err := parseTemplate("key", target.Key); err != nil {
+			return fmt.Errorf("'target.kafka.key' is not a valid template. err=%s", err)
+		}
+	}
+	if target.RequiredAcks == "" {
+		target.RequiredAcks = "all"
+	}
+	if target.RequiredAcks != "all" && target.RequiredAcks != "one" {
+		return errors.New("'target.kafka.requiredAcks' must be 'all' or 'one'")
+	}
+	if target.TimeoutSeconds < 0 {
+		return errors.New("'target.kafka.timeoutSeconds' must be positive")
+	}
+	if target.TimeoutSeconds == 0 {
+		target.TimeoutSeconds = 10
+	}
+	return nil
+}
+
+func (e kafkaExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.Kafka
+	run := Run{WorkflowID: newRunID()}
+
+	key := ""
+	if target.Key != "" {
+		data := newTemplateData(schedule, trigger)
+		data.Input = input
+		var err error
+		key, err = renderTemplate("key", target.Key, data)
+		if err != nil {
+			return Run{}, nil, fmt.Errorf("Couldn't render kafka key. err=%s", err)
+		}
+	}
+	value, err := json.Marshal(messagePayload(trigger, input, run.WorkflowID))
+	if err != nil {
+		return Run{}, nil, err
+	}
+	headers := map[string]string{"schellar-schedule": schedule.Name, "schellar-run-id": run.WorkflowID}
+	for k, v := range target.Headers {
+		headers[k] = v
+	}
+	message := kafkaMessage{Topic: target.Topic, Key: []byte(key), Value: value, Headers: headers}
+
+	startTime := time.Now()
+	err = kafkaProducerInstance.Produce(target, message)
+	run.Result = map[string]interface{}{"topic": target.Topic, "key": key}
+	state := &Workflow{
+		StartTime: startTime.UnixNano() / int64(time.Millisecond),
+		EndTime:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err != nil {
+		logrus.Infof("Schedule %s: Couldn't publish to Kafka topic %s. err=%s", schedule.Name, target.Topic, err)
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = err.Error()
+		return run, state, nil
+	}
+	logrus.Infof("Schedule %s: Message published to Kafka topic %s. runId=%s", schedule.Name, target.Topic, run.WorkflowID)
+	state.Status = "COMPLETED"
+	return run, state, nil
+}
+
+func (e kafkaExecutor) Status(run Run) (*Workflow, error) {
+	return lostRunState(run), nil
+}
+
+func (e kafkaExecutor) Cancel(run Run, reason string) error {
+	return fmt.Errorf("Kafka messages can't be cancelled")
+}
+
+//kafkaGoProducer publishes with kafka-go, keeping one writer per brokers, topic, acks and timeout
+type kafkaGoProducer struct {
+	mutex   sync.Mutex
+	writers map[string]*kafka.Writer
+}
+
+func newKafkaGoProducer() *kafkaGoProducer {
+	return &kafkaGoProducer{writers: make(map[string]*kafka.Writer)}
+}
+
+func (p *kafkaGoProducer) Produce(target *KafkaTarget, message kafkaMessage) error {
+	timeout := time.Duration(target.TimeoutSeconds) * time.Second
+	writer := p.writer(target, timeout)
+	headers := make([]kafka.Header, 0)
+	for k, v := range message.Headers {
+		headers = append(headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return writer.WriteMessages(ctx, kafka.Message{Key: message.Key, Value: message.Value, Headers: headers})
+}
+
+func (p *kafkaGoProducer) writer(target *KafkaTarget, timeout time.Duration) *kafka.Writer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := fmt.Sprintf("%s|%s|%s|%s", strings.Join(target.Brokers, ","), target.Topic, target.RequiredAcks, timeout)
+	writer, exists := p.writers[key]
+	if exists {
+		return writer
+	}
+	acks := kafka.RequireAll
+	if target.RequiredAcks == "one" {
+		acks = kafka.RequireOne
+	}
+	writer = &kafka.Writer{
+		Addr:         kafka.TCP(target.Brokers...),
+		Topic:        target.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: acks,
+		WriteTimeout: timeout,
+		BatchSize:    1,
+	}
+	p.writers[key] = writer
+	return writer
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+//fakeKafkaProducer in-memory broker that keeps published messages by topic
+type fakeKafkaProducer struct {
+	mutex  sync.Mutex
+	topics map[string][]kafkaMessage
+}
+
+func newFakeKafkaProducer() *fakeKafkaProducer {
+	return &fakeKafkaProducer{topics: make(map[string][]kafkaMessage)}
+}
+
+func (p *fakeKafkaProducer) Produce(target *KafkaTarget, message kafkaMessage) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.topics[message.Topic] = append(p.topics[message.Topic], message)
+	logrus.Debugf("Fake Kafka: message published to topic %s. key=%s value=%s", message.Topic, message.Key, message.Value)
+	return nil
+}
+
+//Messages returns the messages published to a topic
+func (p *fakeKafkaProducer) Messages(topic string) []kafkaMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]kafkaMessage{}, p.topics[topic]...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKafkaLaunchKeyAndHeaders(t *testing.T) {
+	fake := newFakeKafkaProducer()
+	defer func(p kafkaProducer) { kafkaProducerInstance = p }(kafkaProducerInstance)
+	kafkaProducerInstance = fake
+
+	schedule := Schedule{
+		Name: "s1",
+		Target: &Target{Type: kafkaTarget, Kafka: &KafkaTarget{
+			Brokers: []string{"kafka:9092"},
+			Topic:   "jobs",
+			Key:     "{{.ScheduleName}}-{{formatTime \"2006-01-02\" .FireTime}}",
+			Headers: map[string]string{"tenant": "abc"},
+		}},
+	}
+	err := kafkaExecutor{}.Validate(&schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fireTime := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	run, state, err := kafkaExecutor{}.Launch(schedule, Trigger{FireTime: fireTime}, map[string]interface{}{"lastDate": "2019-01-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != "COMPLETED" {
+		t.Fatalf("Expected run COMPLETED, got %s", state.Status)
+	}
+
+	messages := fake.Messages("jobs")
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	message := messages[0]
+	if string(message.Key) != "s1-2019-01-02" {
+		t.Errorf("Unexpected message key %s", message.Key)
+	}
+	expectedHeaders := map[string]string{"schellar-schedule": "s1", "schellar-run-id": run.WorkflowID, "tenant": "abc"}
+	if len(message.Headers) != len(expectedHeaders) {
+		t.Errorf("Unexpected message headers %v", message.Headers)
+	}
+	for k, v := range expectedHeaders {
+		if message.Headers[k] != v {
+			t.Errorf("Expected header %s=%s, got %s", k, v, message.Headers[k])
+		}
+	}
+	var value map[string]interface{}
+	err = json.Unmarshal(message.Value, &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value["lastDate"] != "2019-01-01" || value["runId"] != run.WorkflowID || value["fireTime"] != "2019-01-02T03:00:00Z" {
+		t.Errorf("Unexpected message value %v", value)
+	}
+}
+
+func TestKafkaWriterPerSettings(t *testing.T) {
+	producer := newKafkaGoProducer()
+	target := &KafkaTarget{Brokers: []string{"kafka:9092"}, Topic: "jobs", RequiredAcks: "all"}
+	writer := producer.writer(target, 10*time.Second)
+	if producer.writer(target, 10*time.Second) != writer {
+		t.Errorf("Expected the writer to be reused for the same settings")
+	}
+	other := producer.writer(target, 30*time.Second)
+	if other == writer || other.WriteTimeout != 30*time.Second {
+		t.Errorf("Expected a new writer with a 30s timeout, got %s", other.WriteTimeout)
+	}
+	other = producer.writer(&KafkaTarget{Brokers: []string{"kafka:9092"}, Topic: "jobs", RequiredAcks: "one"}, 10*time.Second)
+	if other == writer {
+		t.Errorf("Expected a new writer for other acks")
+	}
+}
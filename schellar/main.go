@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,34 +21,66 @@ var (
 	mongoPassword        string
 	dbName               = "admin"
 	checkIntervalSeconds = 10
+	validateWorkflows    = true
 )
 
 //Schedule struct data
 type Schedule struct {
-	Name                string                 `json:"name,omitempty" bson:"name"`
-	Enabled             bool                   `json:"enabled,omitempty" bson:"enabled"`
-	Status              string                 `json:"status,omitempty" bson:"status"`
-	WorkflowName        string                 `json:"workflowName,omitempty" bson:"workflowName"`
-	WorkflowVersion     string                 `json:"workflowVersion,omitempty" bson:"workflowVersion"`
-	WorkflowContext     map[string]interface{} `json:"workflowContext,omitempty" bson:"workflowContext"`
-	CronString          string                 `json:"cronString,omitempty" bson:"cronString"`
-	ParallelRuns        bool                   `json:"parallelRuns,omitempty" bson:"parallelRuns"`
-	CheckWarningSeconds int                    `json:"checkWarningSeconds,omitempty" bson:"checkWarningSeconds"`
-	FromDate            *time.Time             `json:"fromDate,omitempty" bson:"fromDate"`
-	ToDate              *time.Time             `json:"toDate,omitempty" bson:"toDate"`
-	LastUpdate          time.Time              `json:"lastUpdate,omitempty" bson:"lastUpdate"`
+	Name                  string                 `json:"name,omitempty" bson:"name"`
+	Enabled               bool                   `json:"enabled,omitempty" bson:"enabled"`
+	Status                string                 `json:"status,omitempty" bson:"status"`
+	Target                *Target                `json:"target,omitempty" bson:"target,omitempty"`
+	Conductor             string                 `json:"conductor,omitempty" bson:"conductor,omitempty"`
+	WorkflowName          string                 `json:"workflowName,omitempty" bson:"workflowName"`
+	WorkflowVersion       string                 `json:"workflowVersion,omitempty" bson:"workflowVersion"`
+	WorkflowContext       map[string]interface{} `json:"workflowContext,omitempty" bson:"workflowContext"`
+	CorrelationID         string                 `json:"correlationId,omitempty" bson:"correlationId,omitempty"`
+	WorkflowPriority      int                    `json:"workflowPriority,omitempty" bson:"workflowPriority,omitempty"`
+	TaskToDomain          map[string]string      `json:"taskToDomain,omitempty" bson:"taskToDomain,omitempty"`
+	CreatedBy             string                 `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+	CronString            string                 `json:"cronString,omitempty" bson:"cronString"`
+	ParallelRuns          bool                   `json:"parallelRuns,omitempty" bson:"parallelRuns"`
+	Priority              int                    `json:"priority,omitempty" bson:"priority"`
+	ThrottlePolicy        string                 `json:"throttlePolicy,omitempty" bson:"throttlePolicy,omitempty"`
+	CheckWarningSeconds   int                    `json:"checkWarningSeconds,omitempty" bson:"checkWarningSeconds"`
+	MaxRunDurationSeconds int                    `json:"maxRunDurationSeconds,omitempty" bson:"maxRunDurationSeconds"`
+	FromDate              *time.Time             `json:"fromDate,omitempty" bson:"fromDate"`
+	ToDate                *time.Time             `json:"toDate,omitempty" bson:"toDate"`
+	LastUpdate            time.Time              `json:"lastUpdate,omitempty" bson:"lastUpdate"`
+	Warning               string                 `json:"warning,omitempty" bson:"warning,omitempty"`
+	LastWorkflowID        string                 `json:"lastWorkflowId,omitempty" bson:"lastWorkflowId,omitempty"`
+	RetryPolicy           *RetryPolicy           `json:"retryPolicy,omitempty" bson:"retryPolicy,omitempty"`
+	RetryCount            int                    `json:"retryCount,omitempty" bson:"retryCount,omitempty"`
+	RetryOf               string                 `json:"retryOf,omitempty" bson:"retryOf,omitempty"`
+	NextRetryDate         *time.Time             `json:"nextRetryDate,omitempty" bson:"nextRetryDate,omitempty"`
+	//ContextTemplates the workflowContext values with templates, as defined in the schedule. Only these are rendered,
+	//so workflow outputs merged into workflowContext are never executed as templates
+	ContextTemplates map[string]interface{} `json:"-" bson:"contextTemplates"`
 }
 
-func (schedule Schedule) ValidateAndUpdate() error {
+//RetryPolicy defines how failed workflow runs of a schedule are re-launched
+type RetryPolicy struct {
+	MaxRetries            int     `json:"maxRetries,omitempty" bson:"maxRetries"`
+	InitialBackoffSeconds int     `json:"initialBackoffSeconds,omitempty" bson:"initialBackoffSeconds"`
+	BackoffMultiplier     float64 `json:"backoffMultiplier,omitempty" bson:"backoffMultiplier"`
+}
+
+//Backoff returns how long to wait before launching the given retry attempt (starting at 1)
+func (retryPolicy RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(retryPolicy.InitialBackoffSeconds)
+	for i := 1; i < attempt; i++ {
+		backoff = backoff * retryPolicy.BackoffMultiplier
+	}
+	return time.Duration(backoff) * time.Second
+}
+
+func (schedule *Schedule) ValidateAndUpdate() error {
 	if schedule.Name == "" {
 		return errors.New("'name' is required")
 	}
 	if strings.Contains(schedule.Name, "/") {
 		return errors.New("'name' cannot contain '/' character")
 	}
-	if schedule.WorkflowName == "" {
-		return errors.New("'workflowName' is required")
-	}
 	if schedule.CronString == "" {
 		return errors.New("'cronString' is required")
 	}
@@ -54,8 +88,54 @@ func (schedule Schedule) ValidateAndUpdate() error {
 	if err != nil {
 		return errors.Wrap(err, "'cronString' is invalid")
 	}
-	if schedule.WorkflowVersion == "" {
-		schedule.WorkflowVersion = "1"
+	executor, err := getExecutor(schedule.targetType())
+	if err != nil {
+		return errors.Wrap(err, "'target' is invalid")
+	}
+	//other targets don't need a workflow name, but it identifies their runs and rate limits
+	if schedule.WorkflowName == "" && schedule.targetType() != conductorTarget {
+		schedule.WorkflowName = schedule.Name
+	}
+	err = executor.Validate(schedule)
+	if err != nil {
+		return err
+	}
+	err = validateContextTemplates(schedule.WorkflowContext)
+	if err != nil {
+		return err
+	}
+	schedule.ContextTemplates = contextTemplates(schedule.WorkflowContext)
+	if schedule.CorrelationID != "" {
+		_, err := parseTemplate("correlationId", schedule.CorrelationID)
+		if err != nil {
+			return errors.Wrap(err, "'correlationId' is not a valid template")
+		}
+	}
+	if schedule.WorkflowPriority < 0 || schedule.WorkflowPriority > 99 {
+		return errors.New("'workflowPriority' must be between 0 and 99")
+	}
+	if schedule.MaxRunDurationSeconds < 0 {
+		return errors.New("'maxRunDurationSeconds' must be zero (unlimited) or positive")
+	}
+	if schedule.ThrottlePolicy != "" && schedule.ThrottlePolicy != "delay" && schedule.ThrottlePolicy != "skip" {
+		return errors.New("'throttlePolicy' must be 'delay' or 'skip'")
+	}
+	if schedule.RetryPolicy != nil {
+		if schedule.RetryPolicy.MaxRetries < 0 {
+			return errors.New("'retryPolicy.maxRetries' must be zero or positive")
+		}
+		if schedule.RetryPolicy.InitialBackoffSeconds < 0 {
+			return errors.New("'retryPolicy.initialBackoffSeconds' must be zero or positive")
+		}
+		if schedule.RetryPolicy.BackoffMultiplier != 0 && schedule.RetryPolicy.BackoffMultiplier < 1 {
+			return errors.New("'retryPolicy.backoffMultiplier' must be greater or equal to 1")
+		}
+		if schedule.RetryPolicy.InitialBackoffSeconds == 0 {
+			schedule.RetryPolicy.InitialBackoffSeconds = 60
+		}
+		if schedule.RetryPolicy.BackoffMultiplier == 0 {
+			schedule.RetryPolicy.BackoffMultiplier = 2
+		}
 	}
 	if schedule.CheckWarningSeconds == 0 {
 		schedule.CheckWarningSeconds = 3600
@@ -64,13 +144,86 @@ func (schedule Schedule) ValidateAndUpdate() error {
 	return nil
 }
 
+//definitionVersion the version used to query Conductor metadata. Empty means the latest version
+func (schedule *Schedule) definitionVersion() string {
+	if schedule.WorkflowVersion == latestWorkflowVersion {
+		return ""
+	}
+	return schedule.WorkflowVersion
+}
+
+//ValidateWorkflow checks that the schedule workflow is defined in Conductor.
+//Returns warnings about workflowContext keys that are not input parameters of the workflow definition
+func (schedule *Schedule) ValidateWorkflow() ([]string, error) {
+	client, err := getConductor(schedule.Conductor)
+	if err != nil {
+		return nil, err
+	}
+	def, err := client.GetWorkflowDef(schedule.WorkflowName, schedule.definitionVersion())
+	if err == errWorkflowDefNotFound {
+		return nil, errors.Wrapf(err, "workflow '%s' version '%s'", schedule.WorkflowName, schedule.WorkflowVersion)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't get workflow definition from Conductor")
+	}
+
+	warnings := make([]string, 0)
+	if len(def.InputParameters) == 0 {
+		return warnings, nil
+	}
+	inputParameters := make(map[string]bool)
+	for _, p := range def.InputParameters {
+		inputParameters[p] = true
+	}
+	for k := range schedule.WorkflowContext {
+		if !inputParameters[k] {
+			warnings = append(warnings, fmt.Sprintf("workflowContext key '%s' is not an input parameter of workflow '%s'", k, schedule.WorkflowName))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
 func main() {
 	logLevel := flag.String("loglevel", "debug", "debug, info, warning, error")
 	checkInterval0 := flag.Int("check-interval", 10, "Workflow check interval in seconds")
-	conductorURL0 := flag.String("conductor-api-url", "", "Conductor API URL. Example: http://conductor-server:8080/api")
+	conductorURL0 := flag.String("conductor-api-url", "", "Conductor API URL of the 'default' Conductor. Example: http://conductor-server:8080/api")
+	conductorsConfig0 := flag.String("conductors-config", "", "JSON file with additional named Conductor clusters. Example: {\"eu\": {\"url\": \"http://conductor-eu:8080/api\", \"auth\": {\"token\": \"abc\"}, \"timeoutSeconds\": 10, \"rateLimit\": \"100/1m\"}}")
+	conductorAuthToken0 := flag.String("conductor-auth-token", "", "Static bearer token sent to Conductor")
+	conductorUsername0 := flag.String("conductor-username", "", "Username for basic auth with Conductor")
+	conductorPassword0 := flag.String("conductor-password", "", "Password for basic auth with Conductor")
+	conductorHeaders0 := flag.String("conductor-headers", "", "Custom headers sent to Conductor. Example: 'X-Tenant=abc,X-Other=def'")
+	conductorOAuth2TokenURL0 := flag.String("conductor-oauth2-token-url", "", "OAuth2 token endpoint used to get tokens for Conductor with the client credentials flow")
+	conductorOAuth2ClientID0 := flag.String("conductor-oauth2-client-id", "", "OAuth2 client id")
+	conductorOAuth2ClientSecret0 := flag.String("conductor-oauth2-client-secret", "", "OAuth2 client secret")
+	conductorOAuth2Scopes0 := flag.String("conductor-oauth2-scopes", "", "OAuth2 scopes, comma separated")
+	conductorKeyID0 := flag.String("conductor-key-id", "", "Application key id used to get tokens from Conductor POST /token (Orkes style)")
+	conductorKeySecret0 := flag.String("conductor-key-secret", "", "Application key secret used to get tokens from Conductor POST /token (Orkes style)")
 	mongoAddress0 := flag.String("mongo-address", "", "MongoDB address. Example: 'mongo', or 'mongdb://mongo1:1234/db1,mongo2:1234/db1")
 	mongoUsername0 := flag.String("mongo-username", "root", "MongoDB username")
 	mongoPassword0 := flag.String("mongo-password", "root", "MongoDB password")
+	maxConcurrentLaunches0 := flag.Int("max-concurrent-launches", 10, "Maximum number of workflow launches in flight at the same time. Other launches wait, ordered by schedule priority. 0 means unlimited")
+	workflowRateLimits0 := flag.String("workflow-rate-limits", "", "Maximum launches per workflow name. Example: 'encode_and_deploy=10/1m,other=1/10s'")
+	conductorRateLimit0 := flag.String("conductor-rate-limit", "", "Maximum launches to the 'default' Conductor regardless of workflow name. Example: '100/1m'")
+	conductorTimeout0 := flag.Int("conductor-timeout", 10, "Timeout in seconds for calls to the 'default' Conductor")
+	conductorMaxRetries0 := flag.Int("conductor-max-retries", 3, "Retries of idempotent calls (GET/PUT/DELETE) to the 'default' Conductor when it is unreachable or answers 502/503/504. Zero disables retries")
+	conductorBreakerFailures0 := flag.Int("conductor-breaker-failures", 5, "Consecutive failed calls to the 'default' Conductor that open the circuit breaker, pausing launches. Zero disables the breaker")
+	conductorBreakerOpenSeconds0 := flag.Int("conductor-breaker-open-seconds", 30, "Seconds the circuit breaker stays open before a call is tried again")
+	conductorCAFile0 := flag.String("conductor-ca-file", "", "PEM file with CA certificates used to verify the 'default' Conductor server certificate")
+	conductorCertFile0 := flag.String("conductor-cert-file", "", "PEM client certificate for mutual TLS with the 'default' Conductor")
+	conductorKeyFile0 := flag.String("conductor-key-file", "", "PEM client key for mutual TLS with the 'default' Conductor")
+	conductorInsecureSkipVerify0 := flag.Bool("conductor-insecure-skip-verify", false, "Don't verify the 'default' Conductor server certificate. Use only for testing")
+	throttlePolicy0 := flag.String("throttle-policy", "delay", "What to do with launches exceeding rate limits: 'delay' or 'skip'. Schedules may override it with 'throttlePolicy'")
+	validateWorkflows0 := flag.Bool("validate-workflows", true, "Check that the workflow of a schedule is defined in Conductor when the schedule is created or updated")
+	outboxMaxAttempts0 := flag.Int("outbox-max-attempts", 10, "Number of attempts to launch a failed timer trigger before moving it to dead letter")
+	callbackToken0 := flag.String("callback-token", "", "If defined, calls to POST /callback/workflow must send this value in header 'X-Schellar-Token' or query param 'token'")
+	notificationWebhookURL0 := flag.String("notification-webhook-url", "", "URL that will receive a POST with a JSON body for each event emitted by schellar (like check warnings)")
+	webhookAllowedHosts0 := flag.String("webhook-allowed-hosts", "", "Comma separated host names ('*.example.com' wildcards allowed) or CIDRs that webhook targets can call. Empty allows any host not denied")
+	webhookDeniedHosts0 := flag.String("webhook-denied-hosts", defaultWebhookDeniedHosts, "Comma separated host names ('*.example.com' wildcards allowed) or CIDRs that webhook targets can't call. Also checked against resolved addresses")
+	commandTargetEnabled0 := flag.Bool("command-target-enabled", false, "Allow schedules with 'command' targets, which run local commands with the privileges of schellar")
+	commandAllowedExecutables0 := flag.String("command-allowed-executables", "", "Comma separated executables (absolute paths or names looked up in PATH) that 'command' targets can run. Required if command targets are enabled")
+	grpcDescriptorDir0 := flag.String("grpc-descriptor-dir", "", "Directory with the descriptor set files that 'grpc' targets can use in 'descriptorSetFile'. If empty, only server reflection is used")
+	commandDirRoot0 := flag.String("command-dir-root", "", "Directory under which 'command' targets may set their working directory with 'dir'. If empty, 'dir' can't be used")
 	flag.Parse()
 
 	switch *logLevel {
@@ -88,10 +241,62 @@ func main() {
 	}
 
 	conductorURL = *conductorURL0
-	if conductorURL == "" {
-		logrus.Errorf("'conductor-api-url' parameter is required")
+	if conductorURL == "" && *conductorsConfig0 == "" {
+		logrus.Errorf("'conductor-api-url' or 'conductors-config' parameter is required")
 		os.Exit(1)
 	}
+	if conductorURL != "" {
+		headers, err := parseHeaders(*conductorHeaders0)
+		if err != nil {
+			logrus.Errorf("Invalid 'conductor-headers'. err=%s", err)
+			os.Exit(1)
+		}
+		authConfig := ConductorAuthConfig{
+			Token:              *conductorAuthToken0,
+			Username:           *conductorUsername0,
+			Password:           *conductorPassword0,
+			Headers:            headers,
+			OAuth2TokenURL:     *conductorOAuth2TokenURL0,
+			OAuth2ClientID:     *conductorOAuth2ClientID0,
+			OAuth2ClientSecret: *conductorOAuth2ClientSecret0,
+			KeyID:              *conductorKeyID0,
+			KeySecret:          *conductorKeySecret0,
+		}
+		if *conductorOAuth2Scopes0 != "" {
+			authConfig.OAuth2Scopes = strings.Split(*conductorOAuth2Scopes0, ",")
+		}
+		err = registerConductor(defaultConductorName, ConductorConfig{
+			URL:                conductorURL,
+			Auth:               authConfig,
+			RateLimit:          *conductorRateLimit0,
+			TimeoutSeconds:     *conductorTimeout0,
+			MaxRetries:         conductorMaxRetries0,
+			BreakerFailures:    conductorBreakerFailures0,
+			BreakerOpenSeconds: *conductorBreakerOpenSeconds0,
+			CAFile:             *conductorCAFile0,
+			CertFile:           *conductorCertFile0,
+			KeyFile:            *conductorKeyFile0,
+			InsecureSkipVerify: *conductorInsecureSkipVerify0,
+		})
+		if err != nil {
+			logrus.Errorf("Invalid Conductor configuration. err=%s", err)
+			os.Exit(1)
+		}
+	}
+	if *conductorsConfig0 != "" {
+		configs, err := loadConductorsConfig(*conductorsConfig0)
+		if err != nil {
+			logrus.Errorf("Couldn't load 'conductors-config' %s. err=%s", *conductorsConfig0, err)
+			os.Exit(1)
+		}
+		for name, config := range configs {
+			err := registerConductor(name, config)
+			if err != nil {
+				logrus.Errorf("Invalid 'conductors-config'. err=%s", err)
+				os.Exit(1)
+			}
+		}
+	}
 
 	mongoAddress = *mongoAddress0
 	if mongoAddress == "" {
@@ -103,6 +308,48 @@ func main() {
 	mongoPassword = *mongoPassword0
 
 	checkIntervalSeconds = *checkInterval0
+	notificationWebhookURL = *notificationWebhookURL0
+	outboxMaxAttempts = *outboxMaxAttempts0
+	validateWorkflows = *validateWorkflows0
+	callbackToken = *callbackToken0
+	if callbackToken == "" {
+		logrus.Warnf("CALLBACK_TOKEN is not defined. POST /callback/workflow accepts calls from anyone")
+	}
+	maxConcurrentLaunches = *maxConcurrentLaunches0
+
+	throttlePolicy = *throttlePolicy0
+	if throttlePolicy != "delay" && throttlePolicy != "skip" {
+		logrus.Errorf("'throttle-policy' must be 'delay' or 'skip'")
+		os.Exit(1)
+	}
+	wrl, err := parseWorkflowRateLimits(*workflowRateLimits0)
+	if err != nil {
+		logrus.Errorf("Invalid 'workflow-rate-limits'. err=%s", err)
+		os.Exit(1)
+	}
+	workflowRateLimits = wrl
+	webhookAllowedHosts, err = parseHostRules(*webhookAllowedHosts0)
+	if err != nil {
+		logrus.Errorf("Invalid 'webhook-allowed-hosts'. err=%s", err)
+		os.Exit(1)
+	}
+	webhookDeniedHosts, err = parseHostRules(*webhookDeniedHosts0)
+	if err != nil {
+		logrus.Errorf("Invalid 'webhook-denied-hosts'. err=%s", err)
+		os.Exit(1)
+	}
+	grpcDescriptorDir = *grpcDescriptorDir0
+	commandTargetEnabled = *commandTargetEnabled0
+	commandDirRoot = *commandDirRoot0
+	commandAllowedExecutables, err = parseAllowedExecutables(*commandAllowedExecutables0)
+	if err != nil {
+		logrus.Errorf("Invalid 'command-allowed-executables'. err=%s", err)
+		os.Exit(1)
+	}
+	if commandTargetEnabled && len(commandAllowedExecutables) == 0 {
+		logrus.Errorf("'command-allowed-executables' is required if 'command-target-enabled' is true")
+		os.Exit(1)
+	}
 
 	logrus.Info("====Starting Schellar====")
 
@@ -133,7 +380,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	err := startScheduler()
+	err = startScheduler()
 	if err != nil {
 		logrus.Errorf("Error during scheduler startup. err=%s", err)
 		os.Exit(1)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	checkWarningsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "schellar_check_warnings_total",
+		Help: "Number of workflow runs that exceeded the checkWarningSeconds of their schedule",
+	}, []string{"schedule"})
+
+	workflowRetriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "schellar_workflow_retries_total",
+		Help: "Number of workflow runs re-launched because a previous run failed",
+	}, []string{"schedule"})
+
+	pendingTriggersCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "schellar_pending_triggers_total",
+		Help: "Number of timer triggers whose workflow launch failed and were stored for later replay",
+	}, []string{"schedule"})
+
+	discardedTriggersCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "schellar_discarded_triggers_total",
+		Help: "Number of pending timer triggers discarded without launching their workflow",
+	}, []string{"schedule", "reason"})
+
+	throttledLaunchesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "schellar_throttled_launches_total",
+		Help: "Number of workflow launches delayed or skipped by rate limits",
+	}, []string{"workflow", "policy"})
+
+	circuitOpenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "schellar_conductor_circuit_open",
+		Help: "1 if the circuit breaker of the Conductor cluster is open (launches paused), 0 otherwise",
+	}, []string{"conductor"})
+
+	launchQueueGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "schellar_launch_queue_size",
+		Help: "Number of workflow launches waiting for a free launch slot",
+	})
+
+	launchWaitHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "schellar_launch_wait_seconds",
+		Help:    "Time workflow launches waited for a free launch slot",
+		Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 15, 60, 300},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(checkWarningsCounter)
+	prometheus.MustRegister(workflowRetriesCounter)
+	prometheus.MustRegister(pendingTriggersCounter)
+	prometheus.MustRegister(discardedTriggersCounter)
+	prometheus.MustRegister(throttledLaunchesCounter)
+	prometheus.MustRegister(circuitOpenGauge)
+	prometheus.MustRegister(launchQueueGauge)
+	prometheus.MustRegister(launchWaitHistogram)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const natsTarget = "nats"
+
+//NATSTarget publishes a message to a NATS subject on each trigger
+type NATSTarget struct {
+	URL string `json:"url" bson:"url"`
+	//Subject Go template with the same values as webhook bodies
+	Subject string            `json:"subject" bson:"subject"`
+	Headers map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+	//ReplyTimeoutSeconds if positive, sends a request and waits for its reply, which becomes the run output
+	ReplyTimeoutSeconds int `json:"replyTimeoutSeconds,omitempty" bson:"replyTimeoutSeconds,omitempty"`
+	TimeoutSeconds      int `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+}
+
+//natsMessage a message to be published
+type natsMessage struct {
+	Subject string
+	Headers map[string]string
+	Data    []byte
+}
+
+//natsPublisher publishes messages, returning after the server received them or, if the target
+//waits for replies, with the reply
+type natsPublisher interface {
+	Publish(target *NATSTarget, message natsMessage) ([]byte, error)
+}
+
+var (
+	natsPublisherInstance natsPublisher = newNATSConnPublisher()
+)
+
+//natsExecutor publishes messages to NATS. Runs finish synchronously
+type natsExecutor struct{}
+
+func (e natsExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.NATS
+	if target == nil || target.URL == "" {
+		return errors.New("'target.nats.url' is required")
+	}
+	if target.Subject == "" {
+		return errors.New("'target.nats.subject' is required")
+	}
+	if _, err := parseTemplate("subject", target.Subject); err != nil {
+		return fmt.Errorf("'target.nats.subject' is not a valid template. err=%s", err)
+	}
+	if target.ReplyTimeoutSeconds < 0 || target.TimeoutSeconds < 0 {
+		return errors.New("'target.nats' timeouts must be positive")
+	}
+	if target.TimeoutSeconds == 0 {
+		target.TimeoutSeconds = 10
+	}
+	return nil
+}
+
+func (e natsExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.NATS
+	run := Run{WorkflowID: newRunID()}
+
+	data := newTemplateData(schedule, trigger)
+	data.Input = input
+	subject, err := renderTemplate("subject", target.Subject, data)
+	if err != nil {
+		return Run{}, nil, fmt.Errorf("Couldn't render subject. err=%s", err)
+	}
+	body, err := json.Marshal(messagePayload(trigger, input, run.WorkflowID))
+	if err != nil {
+		return Run{}, nil, err
+	}
+	headers := map[string]string{"Schellar-Schedule": schedule.Name, "Schellar-Run-Id": run.WorkflowID}
+	for k, v := range target.Headers {
+		headers[k] = v
+	}
+	run.Result = map[string]interface{}{"subject": subject}
+
+	startTime := time.Now()
+	reply, err := natsPublisherInstance.Publish(target, natsMessage{Subject: subject, Headers: headers, Data: body})
+	if err != nil {
+		logrus.Infof("Schedule %s: Couldn't publish to NATS subject %s. err=%s", schedule.Name, subject, err)
+	} else {
+		logrus.Infof("Schedule %s: Message published to NATS subject %s. runId=%s", schedule.Name, subject, run.WorkflowID)
+	}
+	return run, messageRunState(&run, startTime, reply, err), nil
+}
+
+func (e natsExecutor) Status(run Run) (*Workflow, error) {
+	return lostRunState(run), nil
+}
+
+func (e natsExecutor) Cancel(run Run, reason string) error {
+	return fmt.Errorf("NATS messages can't be cancelled")
+}
+
+//natsConnPublisher publishes with nats.go, keeping one connection per server URL
+type natsConnPublisher struct {
+	mutex sync.Mutex
+	conns map[string]*nats.Conn
+}
+
+func newNATSConnPublisher() *natsConnPublisher {
+	return &natsConnPublisher{conns: make(map[string]*nats.Conn)}
+}
+
+//connection returns the connection to the server of the target, connecting again if it was closed
+func (p *natsConnPublisher) connection(target *NATSTarget, timeout time.Duration) (*nats.Conn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	nc, exists := p.conns[target.URL]
+	if exists && !nc.IsClosed() {
+		return nc, nil
+	}
+	nc, err := nats.Connect(target.URL, nats.Timeout(timeout), nats.Name("schellar"))
+	if err != nil {
+		return nil, err
+	}
+	p.conns[target.URL] = nc
+	return nc, nil
+}
+
+//Publish publishes the message and waits until the server received it or, if configured, for the reply
+func (p *natsConnPublisher) Publish(target *NATSTarget, message natsMessage) ([]byte, error) {
+	timeout := time.Duration(target.TimeoutSeconds) * time.Second
+	nc, err := p.connection(target, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := nats.NewMsg(message.Subject)
+	msg.Data = message.Data
+	for k, v := range message.Headers {
+		msg.Header.Set(k, v)
+	}
+	if target.ReplyTimeoutSeconds > 0 {
+		reply, err := nc.RequestMsg(msg, time.Duration(target.ReplyTimeoutSeconds)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return reply.Data, nil
+	}
+	err = nc.PublishMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nc.FlushTimeout(timeout)
+}
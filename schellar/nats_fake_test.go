@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+//fakeNATSPublisher in-memory server that keeps published messages by subject and answers them with reply
+type fakeNATSPublisher struct {
+	mutex    sync.Mutex
+	subjects map[string][]natsMessage
+	reply    func(message natsMessage) ([]byte, error)
+}
+
+func newFakeNATSPublisher() *fakeNATSPublisher {
+	return &fakeNATSPublisher{subjects: make(map[string][]natsMessage)}
+}
+
+func (p *fakeNATSPublisher) Publish(target *NATSTarget, message natsMessage) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.subjects[message.Subject] = append(p.subjects[message.Subject], message)
+	logrus.Debugf("Fake NATS: message published to subject %s. data=%s", message.Subject, message.Data)
+	if p.reply == nil {
+		return nil, nil
+	}
+	return p.reply(message)
+}
+
+//Messages returns the messages published to a subject
+func (p *fakeNATSPublisher) Messages(subject string) []natsMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]natsMessage{}, p.subjects[subject]...)
+}
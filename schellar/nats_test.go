@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNATSLaunchMessage(t *testing.T) {
+	fake := newFakeNATSPublisher()
+	defer func(p natsPublisher) { natsPublisherInstance = p }(natsPublisherInstance)
+	natsPublisherInstance = fake
+
+	schedule := Schedule{
+		Name: "s1",
+		Target: &Target{Type: natsTarget, NATS: &NATSTarget{
+			URL:     "nats://nats:4222",
+			Subject: "jobs.{{.ScheduleName}}.{{.Input.region}}",
+			Headers: map[string]string{"Tenant": "abc"},
+		}},
+	}
+	err := natsExecutor{}.Validate(&schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fireTime := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	run, state, err := natsExecutor{}.Launch(schedule, Trigger{FireTime: fireTime}, map[string]interface{}{"region": "eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != "COMPLETED" {
+		t.Fatalf("Expected run COMPLETED, got %s", state.Status)
+	}
+
+	messages := fake.Messages("jobs.s1.eu")
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message on subject jobs.s1.eu, got %d", len(messages))
+	}
+	message := messages[0]
+	if run.Result["subject"] != "jobs.s1.eu" {
+		t.Errorf("Expected subject in the run result, got %v", run.Result)
+	}
+	expectedHeaders := map[string]string{"Schellar-Schedule": "s1", "Schellar-Run-Id": run.WorkflowID, "Tenant": "abc"}
+	if !reflect.DeepEqual(message.Headers, expectedHeaders) {
+		t.Errorf("Expected headers %v, got %v", expectedHeaders, message.Headers)
+	}
+	var data map[string]interface{}
+	err = json.Unmarshal(message.Data, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["region"] != "eu" || data["runId"] != run.WorkflowID || data["fireTime"] != "2019-01-02T03:00:00Z" {
+		t.Errorf("Unexpected message data %v", data)
+	}
+}
+
+func TestNATSLaunchReply(t *testing.T) {
+	fake := newFakeNATSPublisher()
+	defer func(p natsPublisher) { natsPublisherInstance = p }(natsPublisherInstance)
+	natsPublisherInstance = fake
+
+	tests := []struct {
+		name   string
+		reply  []byte
+		err    error
+		status string
+		output map[string]interface{}
+		result interface{}
+	}{
+		{"no reply", nil, nil, "COMPLETED", nil, nil},
+		{"JSON reply", []byte(`{"lastDate":"2019-01-15"}`), nil, "COMPLETED", map[string]interface{}{"lastDate": "2019-01-15"}, map[string]interface{}{"lastDate": "2019-01-15"}},
+		{"text reply", []byte("done"), nil, "COMPLETED", nil, "done"},
+		{"no responders", nil, errors.New("nats: no responders available for request"), "FAILED", nil, nil},
+	}
+	for _, test := range tests {
+		fake.reply = func(message natsMessage) ([]byte, error) {
+			return test.reply, test.err
+		}
+		schedule := Schedule{
+			Name:   "s1",
+			Target: &Target{Type: natsTarget, NATS: &NATSTarget{URL: "nats://nats:4222", Subject: "jobs", ReplyTimeoutSeconds: 1}},
+		}
+		err := natsExecutor{}.Validate(&schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		run, state, err := natsExecutor{}.Launch(schedule, Trigger{FireTime: time.Now()}, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected launch error. err=%s", test.name, err)
+		}
+		if state.Status != test.status {
+			t.Errorf("%s: expected status %s, got %s", test.name, test.status, state.Status)
+		}
+		if test.err != nil && state.ReasonForIncompletion != test.err.Error() {
+			t.Errorf("%s: expected reason '%s', got '%s'", test.name, test.err, state.ReasonForIncompletion)
+		}
+		if !reflect.DeepEqual(state.Output, test.output) {
+			t.Errorf("%s: expected output %v, got %v", test.name, test.output, state.Output)
+		}
+		if !reflect.DeepEqual(run.Result["reply"], test.result) {
+			t.Errorf("%s: expected reply %v in the run result, got %v", test.name, test.result, run.Result["reply"])
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	outboxMaxAttempts     = 10
+	outboxInitialBackoff  = 10 * time.Second
+	outboxMaxBackoff      = 10 * time.Minute
+	pendingTriggersSignal = make(chan bool, 1)
+
+	errScheduleDisabled = errors.New("Schedule is disabled")
+)
+
+//PendingTrigger is a timer trigger whose workflow launch failed and will be replayed later
+type PendingTrigger struct {
+	ID              bson.ObjectId `json:"id" bson:"_id"`
+	ScheduleName    string        `json:"scheduleName" bson:"scheduleName"`
+	Status          string        `json:"status" bson:"status"`
+	Attempts        int           `json:"attempts" bson:"attempts"`
+	LastError       string        `json:"lastError,omitempty" bson:"lastError"`
+	TriggerDate     time.Time     `json:"triggerDate" bson:"triggerDate"`
+	NextAttemptDate time.Time     `json:"nextAttemptDate" bson:"nextAttemptDate"`
+	FireTime        time.Time     `json:"fireTime" bson:"fireTime"`
+}
+
+//enqueuePendingTrigger stores a failed timer trigger so that it will be replayed by the outbox worker
+func enqueuePendingTrigger(scheduleName string, fireTime time.Time, cause error) {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	pt := sc.DB(dbName).C("pendingTriggers")
+
+	now := time.Now()
+	trigger := PendingTrigger{
+		ID:              bson.NewObjectId(),
+		ScheduleName:    scheduleName,
+		Status:          "PENDING",
+		Attempts:        1,
+		LastError:       cause.Error(),
+		TriggerDate:     now,
+		FireTime:        fireTime,
+		NextAttemptDate: now.Add(outboxBackoff(1)),
+	}
+	err := pt.Insert(trigger)
+	if err != nil {
+		logrus.Errorf("Couldn't store pending trigger for schedule %s. Trigger lost. err=%s", scheduleName, err)
+		return
+	}
+	pendingTriggersCounter.WithLabelValues(scheduleName).Inc()
+}
+
+//outboxBackoff returns how long to wait before the next replay after the given number of attempts
+func outboxBackoff(attempts int) time.Duration {
+	backoff := float64(outboxInitialBackoff) * math.Pow(2, float64(attempts-1))
+	if backoff > float64(outboxMaxBackoff) {
+		return outboxMaxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+//replayPendingTriggers keeps replaying pending triggers whose next attempt date was reached
+func replayPendingTriggers() {
+	logrus.Debugf("Starting to replay pending triggers")
+	for {
+		err := replayDuePendingTriggers()
+		if err != nil {
+			logrus.Errorf("Error replaying pending triggers. err=%s", err)
+		}
+		select {
+		case <-pendingTriggersSignal:
+		case <-time.After(time.Duration(checkIntervalSeconds) * time.Second):
+		}
+	}
+}
+
+func replayDuePendingTriggers() error {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	pt := sc.DB(dbName).C("pendingTriggers")
+
+	triggers := make([]PendingTrigger, 0)
+	err := pt.Find(bson.M{"status": "PENDING", "nextAttemptDate": bson.M{"$lte": time.Now()}}).Sort("triggerDate").All(&triggers)
+	if err != nil {
+		return err
+	}
+
+	for _, trigger := range triggers {
+		logrus.Debugf("Replaying pending trigger %s for schedule %s. attempt=%d", trigger.ID.Hex(), trigger.ScheduleName, trigger.Attempts+1)
+		err := replayPendingTrigger(trigger)
+		if err == errCircuitOpen {
+			//Conductor is down. Wait for it without spending replay attempts
+			continue
+		}
+		if err == errLaunchThrottled {
+			//throttling is not a launch failure. Try again later without spending replay attempts
+			logrus.Infof("Schedule %s: Replay of pending trigger %s skipped by rate limit", trigger.ScheduleName, trigger.ID.Hex())
+			err = pt.UpdateId(trigger.ID, bson.M{"$set": bson.M{"nextAttemptDate": time.Now().Add(outboxBackoff(trigger.Attempts))}})
+			if err != nil {
+				logrus.Errorf("Couldn't update pending trigger %s. err=%s", trigger.ID.Hex(), err)
+			}
+			continue
+		}
+		if err == errScheduleDisabled {
+			//kept as DISCARDED so that it can still be inspected and replayed manually
+			logrus.Infof("Schedule %s: Discarding pending trigger %s because the schedule is disabled", trigger.ScheduleName, trigger.ID.Hex())
+			discardedTriggersCounter.WithLabelValues(trigger.ScheduleName, "schedule_disabled").Inc()
+			err = pt.UpdateId(trigger.ID, bson.M{"$set": bson.M{"status": "DISCARDED", "lastError": errScheduleDisabled.Error()}})
+			if err != nil {
+				logrus.Errorf("Couldn't update pending trigger %s. err=%s", trigger.ID.Hex(), err)
+			}
+			continue
+		}
+		if err == nil {
+			logrus.Infof("Schedule %s: Pending trigger %s replayed successfully", trigger.ScheduleName, trigger.ID.Hex())
+			err = pt.RemoveId(trigger.ID)
+			if err != nil {
+				logrus.Errorf("Couldn't remove replayed trigger %s. err=%s", trigger.ID.Hex(), err)
+			}
+			continue
+		}
+
+		attempts := trigger.Attempts + 1
+		update := bson.M{"attempts": attempts, "lastError": err.Error()}
+		if attempts >= outboxMaxAttempts {
+			logrus.Warnf("Schedule %s: Pending trigger %s failed %d times. Moving it to dead letter. err=%s", trigger.ScheduleName, trigger.ID.Hex(), attempts, err)
+			update["status"] = "DEAD"
+			emitEvent("TRIGGER_DEAD", trigger.ScheduleName, fmt.Sprintf("Trigger from %s couldn't be launched after %d attempts", trigger.TriggerDate, attempts), map[string]interface{}{
+				"pendingTriggerId": trigger.ID.Hex(),
+				"lastError":        err.Error(),
+			})
+		} else {
+			logrus.Infof("Schedule %s: Pending trigger %s failed again. attempt=%d. err=%s", trigger.ScheduleName, trigger.ID.Hex(), attempts, err)
+			update["nextAttemptDate"] = time.Now().Add(outboxBackoff(attempts))
+		}
+		err = pt.UpdateId(trigger.ID, bson.M{"$set": update})
+		if err != nil {
+			logrus.Errorf("Couldn't update pending trigger %s. err=%s", trigger.ID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+func replayPendingTrigger(trigger PendingTrigger) error {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	st := sc.DB(dbName).C("schedules")
+
+	var schedule Schedule
+	err := st.Find(bson.M{"name": trigger.ScheduleName}).One(&schedule)
+	if err != nil {
+		return fmt.Errorf("Couldn't get schedule %s. err=%s", trigger.ScheduleName, err)
+	}
+	if !schedule.Enabled {
+		return errScheduleDisabled
+	}
+	if !targetAvailable(schedule) {
+		return errCircuitOpen
+	}
+	fireTime := trigger.FireTime
+	if fireTime.IsZero() {
+		fireTime = trigger.TriggerDate
+	}
+	return startScheduledRun(schedule, Trigger{FireTime: fireTime})
+}
+
+//signalPendingTriggers wakes up the outbox worker so that due triggers are replayed right away
+func signalPendingTriggers() {
+	select {
+	case pendingTriggersSignal <- true:
+	default:
+	}
+}
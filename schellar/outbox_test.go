@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//makeTriggersDue skips the replay backoff of all pending triggers
+func makeTriggersDue(t *testing.T) {
+	_, err := mongoSession.DB(dbName).C("pendingTriggers").UpdateAll(bson.M{}, bson.M{"$set": bson.M{"nextAttemptDate": time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayPendingTriggerKeepsFireTime(t *testing.T) {
+	conductor := setupScheduler(t)
+	createTestSchedule(t, Schedule{Name: "s1", WorkflowName: "encode"})
+	fireTime := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	enqueuePendingTrigger("s1", fireTime, errors.New("Conductor unreachable"))
+	makeTriggersDue(t)
+
+	err := replayDuePendingTriggers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := runningTestRun(t, "s1")
+	if !run.FireTime.Equal(fireTime) {
+		t.Errorf("Expected replayed run with fire time %s, got %s", fireTime, run.FireTime)
+	}
+	if len(conductor.workflows) != 1 {
+		t.Errorf("Expected 1 launched workflow, got %d", len(conductor.workflows))
+	}
+	n, _ := mongoSession.DB(dbName).C("pendingTriggers").Count()
+	if n != 0 {
+		t.Errorf("Expected replayed trigger to be removed, found %d", n)
+	}
+}
+
+func TestReplayPendingTriggerOfDisabledSchedule(t *testing.T) {
+	conductor := setupScheduler(t)
+	createTestSchedule(t, Schedule{Name: "s1", WorkflowName: "encode"})
+	err := mongoSession.DB(dbName).C("schedules").Update(bson.M{"name": "s1"}, bson.M{"$set": bson.M{"enabled": false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueuePendingTrigger("s1", time.Now(), errors.New("Conductor unreachable"))
+	makeTriggersDue(t)
+
+	err = replayDuePendingTriggers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conductor.workflows) != 0 {
+		t.Errorf("Expected no launches for a disabled schedule")
+	}
+	var trigger PendingTrigger
+	err = mongoSession.DB(dbName).C("pendingTriggers").Find(nil).One(&trigger)
+	if err != nil {
+		t.Fatalf("Expected trigger to be kept. err=%s", err)
+	}
+	if trigger.Status != "DISCARDED" || trigger.Attempts != 1 {
+		t.Errorf("Expected trigger DISCARDED without new attempts, got %s %d", trigger.Status, trigger.Attempts)
+	}
+}
+
+func TestDiscardPendingTrigger(t *testing.T) {
+	conductor := setupScheduler(t)
+	createTestSchedule(t, Schedule{Name: "s1", WorkflowName: "encode"})
+	enqueuePendingTrigger("s1", time.Now(), errors.New("Conductor unreachable"))
+	var trigger PendingTrigger
+	err := mongoSession.DB(dbName).C("pendingTriggers").Find(nil).One(&trigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/pending/"+trigger.ID.Hex()+"/discard", nil)
+	discardPendingTrigger(w, mux.SetURLVars(r, map[string]string{"id": trigger.ID.Hex()}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected discard response %d %s", w.Code, w.Body.String())
+	}
+	err = mongoSession.DB(dbName).C("pendingTriggers").FindId(trigger.ID).One(&trigger)
+	if err != nil {
+		t.Fatalf("Expected discarded trigger to be kept. err=%s", err)
+	}
+	if trigger.Status != "DISCARDED" {
+		t.Errorf("Expected trigger DISCARDED, got %s", trigger.Status)
+	}
+
+	makeTriggersDue(t)
+	err = replayDuePendingTriggers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conductor.workflows) != 0 {
+		t.Errorf("Expected discarded trigger not to be replayed")
+	}
+
+	w = httptest.NewRecorder()
+	id := bson.NewObjectId().Hex()
+	discardPendingTrigger(w, mux.SetURLVars(httptest.NewRequest("POST", "/pending/"+id+"/discard", nil), map[string]string{"id": id}))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown trigger to be not found, got %d", w.Code)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	throttlePolicy = "delay"
+
+	rateLimitsMutex    sync.Mutex
+	workflowRateLimits = make(map[string]*tokenBucket)
+	//rate limits per Conductor cluster name
+	conductorRateLimits = make(map[string]*tokenBucket)
+
+	errLaunchThrottled = errors.New("launch throttled by rate limit")
+)
+
+//tokenBucket allows up to capacity launches at once, refilling capacity tokens every period
+type tokenBucket struct {
+	capacity        float64
+	tokens          float64
+	refillPerSecond float64
+	lastRefill      time.Time
+}
+
+func newTokenBucket(capacity int, period time.Duration) *tokenBucket {
+	return &tokenBucket{
+		capacity:        float64(capacity),
+		tokens:          float64(capacity),
+		refillPerSecond: float64(capacity) / period.Seconds(),
+		lastRefill:      time.Now(),
+	}
+}
+
+//wait refills the bucket and returns how long to wait until a token is available (zero if available now)
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.tokens = b.tokens + now.Sub(b.lastRefill).Seconds()*b.refillPerSecond
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.lastRefill = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.refillPerSecond * float64(time.Second))
+}
+
+//parseRateLimit parses limits in the form "[count]/[period]", like "10/1m"
+func parseRateLimit(spec string) (*tokenBucket, error) {
+	parts := strings.Split(strings.TrimSpace(spec), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid rate limit '%s'. Use [count]/[period], like 10/1m", spec)
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("Invalid rate limit count in '%s'", spec)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("Invalid rate limit period in '%s'", spec)
+	}
+	return newTokenBucket(count, period), nil
+}
+
+//parseWorkflowRateLimits parses limits in the form "[workflowName]=[count]/[period],..."
+func parseWorkflowRateLimits(spec string) (map[string]*tokenBucket, error) {
+	limits := make(map[string]*tokenBucket)
+	if strings.TrimSpace(spec) == "" {
+		return limits, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid workflow rate limit '%s'. Use [workflowName]=[count]/[period]", entry)
+		}
+		bucket, err := parseRateLimit(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(kv[0])] = bucket
+	}
+	return limits, nil
+}
+
+//acquireLaunchToken takes a token from the rate limits that apply to the schedule's workflow and Conductor.
+//Depending on the throttle policy, it waits for tokens to become available or returns errLaunchThrottled.
+//If block is false, it never waits and returns errLaunchThrottled for delayed launches too
+func acquireLaunchToken(schedule Schedule, block bool) error {
+	policy := throttlePolicy
+	if schedule.ThrottlePolicy != "" {
+		policy = schedule.ThrottlePolicy
+	}
+	//Conductor rate limits only apply to schedules launching on Conductor
+	conductorName := ""
+	if schedule.targetType() == conductorTarget {
+		conductorName = schedule.Conductor
+		if conductorName == "" {
+			conductorName = defaultConductorName
+		}
+	}
+	throttled := false
+	for {
+		wait := tryAcquireLaunchToken(schedule.WorkflowName, conductorName)
+		if wait == 0 {
+			return nil
+		}
+		//a delayed launch may wait several times, but it is counted once
+		if !throttled {
+			throttledLaunchesCounter.WithLabelValues(schedule.WorkflowName, policy).Inc()
+			throttled = true
+		}
+		if policy == "skip" {
+			logrus.Infof("Schedule %s: Launch of workflow %s skipped by rate limit", schedule.Name, schedule.WorkflowName)
+			return errLaunchThrottled
+		}
+		if !block {
+			logrus.Debugf("Schedule %s: Launch of workflow %s postponed by rate limit", schedule.Name, schedule.WorkflowName)
+			return errLaunchThrottled
+		}
+		logrus.Debugf("Schedule %s: Launch of workflow %s delayed by rate limit for %s", schedule.Name, schedule.WorkflowName, wait)
+		time.Sleep(wait)
+	}
+}
+
+func tryAcquireLaunchToken(workflowName string, conductorName string) time.Duration {
+	rateLimitsMutex.Lock()
+	defer rateLimitsMutex.Unlock()
+
+	now := time.Now()
+	buckets := make([]*tokenBucket, 0)
+	if b, exists := workflowRateLimits[workflowName]; exists {
+		buckets = append(buckets, b)
+	}
+	if b, exists := conductorRateLimits[conductorName]; exists && conductorName != "" {
+		buckets = append(buckets, b)
+	}
+
+	var wait time.Duration
+	for _, b := range buckets {
+		w := b.wait(now)
+		if w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
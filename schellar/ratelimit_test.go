@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//useRateLimits replaces the rate limits for the duration of a test
+func useRateLimits(t *testing.T, workflows map[string]*tokenBucket, clusters map[string]*tokenBucket) {
+	previousWorkflows, previousClusters, previousPolicy := workflowRateLimits, conductorRateLimits, throttlePolicy
+	workflowRateLimits, conductorRateLimits = workflows, clusters
+	t.Cleanup(func() {
+		workflowRateLimits, conductorRateLimits, throttlePolicy = previousWorkflows, previousClusters, previousPolicy
+	})
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		spec            string
+		valid           bool
+		capacity        float64
+		refillPerSecond float64
+	}{
+		{"10/1m", true, 10, 10.0 / 60},
+		{" 2/1s ", true, 2, 2},
+		{"1/500ms", true, 1, 2},
+		{"10", false, 0, 0},
+		{"10/1m/1h", false, 0, 0},
+		{"x/1m", false, 0, 0},
+		{"0/1m", false, 0, 0},
+		{"-1/1m", false, 0, 0},
+		{"10/x", false, 0, 0},
+		{"10/0s", false, 0, 0},
+	}
+	for _, test := range tests {
+		bucket, err := parseRateLimit(test.spec)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error. err=%s", test.spec, err)
+			continue
+		}
+		if bucket.capacity != test.capacity || bucket.tokens != test.capacity || bucket.refillPerSecond != test.refillPerSecond {
+			t.Errorf("%s: expected capacity %v refilling %v/s, got %+v", test.spec, test.capacity, test.refillPerSecond, bucket)
+		}
+	}
+
+	limits, err := parseWorkflowRateLimits("encode=10/1m, publish = 1/1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["encode"] == nil || limits["publish"] == nil {
+		t.Errorf("Expected limits for encode and publish, got %v", limits)
+	}
+	for _, spec := range []string{"encode", "=10/1m", "encode=10"} {
+		_, err = parseWorkflowRateLimits(spec)
+		if err == nil {
+			t.Errorf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestTokenBucketRefillAndWait(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		wait    time.Duration
+		left    float64
+	}{
+		{"full", 2, 0, 0, 2},
+		{"one left", 1, 0, 0, 1},
+		{"empty", 0, 0, 30 * time.Second, 0},
+		{"partially refilled", 0, 15 * time.Second, 15 * time.Second, 0.5},
+		{"refilled", 0, 30 * time.Second, 0, 1},
+		{"capped at capacity", 0, time.Hour, 0, 2},
+	}
+	for _, test := range tests {
+		//2 launches per minute refill a token every 30s
+		bucket := newTokenBucket(2, time.Minute)
+		bucket.tokens = test.tokens
+		bucket.lastRefill = start
+		wait := bucket.wait(start.Add(test.elapsed))
+		if wait != test.wait {
+			t.Errorf("%s: expected wait %s, got %s", test.name, test.wait, wait)
+		}
+		if bucket.tokens != test.left {
+			t.Errorf("%s: expected %v tokens, got %v", test.name, test.left, bucket.tokens)
+		}
+	}
+}
+
+func TestAcquireLaunchToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		schedule string
+		block    bool
+		err      error
+		minWait  time.Duration
+	}{
+		{"skip", "skip", "", true, errLaunchThrottled, 0},
+		{"delay", "delay", "", true, nil, 80 * time.Millisecond},
+		{"schedule policy overrides default", "delay", "skip", true, errLaunchThrottled, 0},
+		{"delay without blocking", "delay", "", false, errLaunchThrottled, 0},
+	}
+	for _, test := range tests {
+		//one launch every 100ms
+		useRateLimits(t, map[string]*tokenBucket{"encode": newTokenBucket(1, 100*time.Millisecond)}, map[string]*tokenBucket{})
+		throttlePolicy = test.policy
+		schedule := Schedule{Name: "s1", WorkflowName: "encode", ThrottlePolicy: test.schedule}
+
+		err := acquireLaunchToken(schedule, test.block)
+		if err != nil {
+			t.Fatalf("%s: expected first launch to be allowed. err=%s", test.name, err)
+		}
+		start := time.Now()
+		err = acquireLaunchToken(schedule, test.block)
+		if err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		elapsed := time.Since(start)
+		if elapsed < test.minWait {
+			t.Errorf("%s: expected to wait at least %s, waited %s", test.name, test.minWait, elapsed)
+		}
+		if test.err != nil && elapsed > 50*time.Millisecond {
+			t.Errorf("%s: expected to return without waiting, waited %s", test.name, elapsed)
+		}
+	}
+}
+
+func TestConductorRateLimitOnlyAppliesToConductorTargets(t *testing.T) {
+	useRateLimits(t, map[string]*tokenBucket{}, map[string]*tokenBucket{defaultConductorName: newTokenBucket(1, time.Hour)})
+	throttlePolicy = "skip"
+
+	conductorSchedule := Schedule{Name: "s1", WorkflowName: "encode"}
+	err := acquireLaunchToken(conductorSchedule, true)
+	if err != nil {
+		t.Fatalf("Expected first launch to be allowed. err=%s", err)
+	}
+	err = acquireLaunchToken(conductorSchedule, true)
+	if err != errLaunchThrottled {
+		t.Errorf("Expected Conductor rate limit to throttle, got %v", err)
+	}
+	webhookSchedule := Schedule{Name: "s2", WorkflowName: "encode", Target: &Target{Type: webhookTarget, Webhook: &WebhookTarget{URL: "http://localhost/hook"}}}
+	err = acquireLaunchToken(webhookSchedule, true)
+	if err != nil {
+		t.Errorf("Expected webhook launch not to be limited by Conductor rate limits. err=%s", err)
+	}
+}
+
+func TestThrottledRetryStaysPending(t *testing.T) {
+	conductor := setupScheduler(t)
+	useRateLimits(t, map[string]*tokenBucket{"encode": newTokenBucket(1, time.Hour)}, map[string]*tokenBucket{})
+	throttlePolicy = "delay"
+	createTestSchedule(t, Schedule{
+		Name:         "s1",
+		WorkflowName: "encode",
+		RetryPolicy:  &RetryPolicy{MaxRetries: 1},
+	})
+	err := startScheduledRun(loadTestSchedule(t, "s1"), Trigger{FireTime: time.Now()})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	failed := runningTestRun(t, "s1")
+	conductor.FinishWorkflow(failed.WorkflowID, "FAILED", nil)
+	checkScheduleRuns("s1", nil)
+	err = mongoSession.DB(dbName).C("schedules").Update(bson.M{"name": "s1"}, bson.M{"$set": bson.M{"nextRetryDate": time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the bucket is empty for an hour. The retry must not wait for it
+	done := make(chan struct{})
+	go func() {
+		launchPendingRetries()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected throttled retry not to block")
+	}
+	schedule := loadTestSchedule(t, "s1")
+	if schedule.Status != "WAITING_RETRY" || schedule.RetryCount != 0 {
+		t.Fatalf("Expected schedule to keep WAITING_RETRY, got %s retryCount=%d", schedule.Status, schedule.RetryCount)
+	}
+
+	workflowRateLimits["encode"].tokens = 1
+	launchPendingRetries()
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "RUNNING" || schedule.RetryCount != 1 {
+		t.Errorf("Expected retry to be launched on the next check, got %s retryCount=%d", schedule.Status, schedule.RetryCount)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const redisTarget = "redis"
+
+//RedisTarget adds an entry to a Redis stream or list on each trigger
+type RedisTarget struct {
+	//URL Redis URL. Example: 'redis://:password@redis:6379/0'
+	URL string `json:"url" bson:"url"`
+	//Key Go template with the same values as webhook bodies
+	Key string `json:"key" bson:"key"`
+	//Mode 'stream' (default) for XADD or 'list' for LPUSH
+	Mode string `json:"mode,omitempty" bson:"mode,omitempty"`
+	//Fields additional stream entry fields
+	Fields map[string]string `json:"fields,omitempty" bson:"fields,omitempty"`
+	//MaxLen if defined, streams are trimmed to approximately this length
+	MaxLen         int64 `json:"maxLen,omitempty" bson:"maxLen,omitempty"`
+	TimeoutSeconds int   `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+}
+
+//redisWriter adds entries to Redis streams and lists
+type redisWriter interface {
+	XAdd(ctx context.Context, target *RedisTarget, args *redis.XAddArgs) (string, error)
+	LPush(ctx context.Context, target *RedisTarget, key string, value []byte) (int64, error)
+}
+
+var (
+	redisWriterInstance redisWriter = goRedisWriter{}
+
+	redisClients      = make(map[string]*redis.Client)
+	redisClientsMutex = &sync.Mutex{}
+)
+
+//redisExecutor publishes to Redis streams and lists. Runs finish synchronously when the entry is added
+type redisExecutor struct{}
+
+func (e redisExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.Redis
+	if target == nil || target.URL == "" {
+		return errors.New("'target.redis.url' is required")
+	}
+	if _, err := redis.ParseURL(target.URL); err != nil {
+		return fmt.Errorf("'target.redis.url' is invalid. err=%s", err)
+	}
+	if target.Key == "" {
+		return errors.New("'target.redis.key' is required")
+	}
+	if _, err := parseTemplate("key", target.Key); err != nil {
+		return fmt.Errorf("'target.redis.key' is not a valid template. err=%s", err)
+	}
+	if target.Mode == "" {
+		target.Mode = "stream"
+	}
+	if target.Mode != "stream" && target.Mode != "list" {
+		return errors.New("'target.redis.mode' must be 'stream' or 'list'")
+	}
+	if target.MaxLen < 0 {
+		return errors.New("'target.redis.maxLen' must be positive")
+	}
+	if target.TimeoutSeconds < 0 {
+		return errors.New("'target.redis.timeoutSeconds' must be positive")
+	}
+	if target.TimeoutSeconds == 0 {
+		target.TimeoutSeconds = 10
+	}
+	return nil
+}
+
+func (e redisExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.Redis
+	run := Run{WorkflowID: newRunID()}
+
+	data := newTemplateData(schedule, trigger)
+	data.Input = input
+	key, err := renderTemplate("key", target.Key, data)
+	if err != nil {
+		return Run{}, nil, fmt.Errorf("Couldn't render redis key. err=%s", err)
+	}
+	payload := messagePayload(trigger, input, run.WorkflowID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(target.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	startTime := time.Now()
+	run.Result = map[string]interface{}{"key": key, "mode": target.Mode}
+	if target.Mode == "list" {
+		var value []byte
+		value, err = json.Marshal(payload)
+		if err != nil {
+			return Run{}, nil, err
+		}
+		var length int64
+		length, err = redisWriterInstance.LPush(ctx, target, key, value)
+		run.Result["length"] = length
+	} else {
+		var id string
+		id, err = redisWriterInstance.XAdd(ctx, target, &redis.XAddArgs{
+			Stream: key,
+			MaxLen: target.MaxLen,
+			Approx: target.MaxLen > 0,
+			Values: redisStreamFields(target, payload),
+		})
+		run.Result["entryId"] = id
+	}
+	state := &Workflow{
+		StartTime: startTime.UnixNano() / int64(time.Millisecond),
+		EndTime:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err != nil {
+		logrus.Infof("Schedule %s: Couldn't publish to Redis %s %s. err=%s", schedule.Name, target.Mode, key, err)
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = err.Error()
+		return run, state, nil
+	}
+	logrus.Infof("Schedule %s: Entry added to Redis %s %s. runId=%s", schedule.Name, target.Mode, key, run.WorkflowID)
+	state.Status = "COMPLETED"
+	return run, state, nil
+}
+
+func (e redisExecutor) Status(run Run) (*Workflow, error) {
+	return lostRunState(run), nil
+}
+
+func (e redisExecutor) Cancel(run Run, reason string) error {
+	return fmt.Errorf("Redis entries can't be cancelled")
+}
+
+//goRedisWriter writes with go-redis clients
+type goRedisWriter struct{}
+
+func (w goRedisWriter) XAdd(ctx context.Context, target *RedisTarget, args *redis.XAddArgs) (string, error) {
+	client, err := getRedisClient(target.URL)
+	if err != nil {
+		return "", err
+	}
+	return client.XAdd(ctx, args).Result()
+}
+
+func (w goRedisWriter) LPush(ctx context.Context, target *RedisTarget, key string, value []byte) (int64, error) {
+	client, err := getRedisClient(target.URL)
+	if err != nil {
+		return 0, err
+	}
+	return client.LPush(ctx, key, value).Result()
+}
+
+//getRedisClient returns a client for a Redis URL, reusing its connection pool among launches
+func getRedisClient(url string) (*redis.Client, error) {
+	redisClientsMutex.Lock()
+	defer redisClientsMutex.Unlock()
+	client, exists := redisClients[url]
+	if exists {
+		return client, nil
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client = redis.NewClient(options)
+	redisClients[url] = client
+	return client, nil
+}
+
+//redisStreamFields stream entry fields with the payload values (strings as is, other values as JSON) and the target fields
+func redisStreamFields(target *RedisTarget, payload map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for k, v := range payload {
+		if s, ok := v.(string); ok {
+			fields[k] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		fields[k] = string(b)
+	}
+	for k, v := range target.Fields {
+		fields[k] = v
+	}
+	return fields
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+//fakeRedisWriter in-memory Redis that keeps stream entries and list values by key
+type fakeRedisWriter struct {
+	mutex   sync.Mutex
+	streams map[string][]redis.XAddArgs
+	lists   map[string][][]byte
+	err     error
+}
+
+func newFakeRedisWriter() *fakeRedisWriter {
+	return &fakeRedisWriter{streams: make(map[string][]redis.XAddArgs), lists: make(map[string][][]byte)}
+}
+
+func (w *fakeRedisWriter) XAdd(ctx context.Context, target *RedisTarget, args *redis.XAddArgs) (string, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return "", w.err
+	}
+	w.streams[args.Stream] = append(w.streams[args.Stream], *args)
+	logrus.Debugf("Fake Redis: entry added to stream %s. values=%v", args.Stream, args.Values)
+	return fmt.Sprintf("%d-0", len(w.streams[args.Stream])), nil
+}
+
+func (w *fakeRedisWriter) LPush(ctx context.Context, target *RedisTarget, key string, value []byte) (int64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.lists[key] = append([][]byte{value}, w.lists[key]...)
+	logrus.Debugf("Fake Redis: value pushed to list %s. value=%s", key, value)
+	return int64(len(w.lists[key])), nil
+}
+
+//Stream returns the entries added to a stream
+func (w *fakeRedisWriter) Stream(key string) []redis.XAddArgs {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]redis.XAddArgs{}, w.streams[key]...)
+}
+
+//List returns the values of a list, from head to tail
+func (w *fakeRedisWriter) List(key string) [][]byte {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([][]byte{}, w.lists[key]...)
+}
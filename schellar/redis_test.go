@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisStreamFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload map[string]interface{}
+		fields  map[string]string
+		result  map[string]interface{}
+	}{
+		{"strings as is", map[string]interface{}{"lastDate": "2019-01-01"}, nil, map[string]interface{}{"lastDate": "2019-01-01"}},
+		{"other values as JSON", map[string]interface{}{"count": 3, "dryRun": true, "ids": []int{1, 2}, "filter": map[string]interface{}{"region": "eu"}, "none": nil},
+			nil, map[string]interface{}{"count": "3", "dryRun": "true", "ids": "[1,2]", "filter": `{"region":"eu"}`, "none": "null"}},
+		{"extra fields", map[string]interface{}{"lastDate": "2019-01-01"}, map[string]string{"source": "schellar"}, map[string]interface{}{"lastDate": "2019-01-01", "source": "schellar"}},
+		{"extra fields replace payload values", map[string]interface{}{"source": "input"}, map[string]string{"source": "schellar"}, map[string]interface{}{"source": "schellar"}},
+	}
+	for _, test := range tests {
+		fields := redisStreamFields(&RedisTarget{Fields: test.fields}, test.payload)
+		if !reflect.DeepEqual(fields, test.result) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.result, fields)
+		}
+	}
+}
+
+func TestRedisValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		target RedisTarget
+		valid  bool
+		mode   string
+	}{
+		{"stream by default", RedisTarget{URL: "redis://redis:6379/0", Key: "jobs"}, true, "stream"},
+		{"list", RedisTarget{URL: "redis://redis:6379/0", Key: "jobs", Mode: "list"}, true, "list"},
+		{"invalid mode", RedisTarget{URL: "redis://redis:6379/0", Key: "jobs", Mode: "set"}, false, ""},
+		{"invalid URL", RedisTarget{URL: "http://redis:6379/0", Key: "jobs"}, false, ""},
+		{"missing key", RedisTarget{URL: "redis://redis:6379/0"}, false, ""},
+		{"invalid key template", RedisTarget{URL: "redis://redis:6379/0", Key: "{{.ScheduleName"}, false, ""},
+		{"negative maxLen", RedisTarget{URL: "redis://redis:6379/0", Key: "jobs", MaxLen: -1}, false, ""},
+	}
+	for _, test := range tests {
+		target := test.target
+		err := redisExecutor{}.Validate(&Schedule{Name: "s1", Target: &Target{Type: redisTarget, Redis: &target}})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%t, got err=%v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && target.Mode != test.mode {
+			t.Errorf("%s: expected mode %s, got %s", test.name, test.mode, target.Mode)
+		}
+	}
+}
+
+func TestRedisLaunch(t *testing.T) {
+	fake := newFakeRedisWriter()
+	defer func(w redisWriter) { redisWriterInstance = w }(redisWriterInstance)
+	redisWriterInstance = fake
+
+	tests := []struct {
+		name   string
+		mode   string
+		maxLen int64
+		err    error
+		status string
+	}{
+		{"stream", "stream", 0, nil, "COMPLETED"},
+		{"stream with maxLen", "stream", 1000, nil, "COMPLETED"},
+		{"list", "list", 0, nil, "COMPLETED"},
+		{"list ignores maxLen", "list", 1000, nil, "COMPLETED"},
+		{"failure", "stream", 0, errors.New("connection refused"), "FAILED"},
+	}
+	fireTime := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	for i, test := range tests {
+		fake.err = test.err
+		schedule := Schedule{
+			Name: "s1",
+			Target: &Target{Type: redisTarget, Redis: &RedisTarget{
+				URL:    "redis://:password@redis:6379/0",
+				Key:    "jobs:{{.ScheduleName}}:{{.Input.region}}",
+				Mode:   test.mode,
+				Fields: map[string]string{"source": "schellar"},
+				MaxLen: test.maxLen,
+			}},
+		}
+		err := redisExecutor{}.Validate(&schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		run, state, err := redisExecutor{}.Launch(schedule, Trigger{FireTime: fireTime}, map[string]interface{}{"region": "eu", "count": i})
+		if err != nil {
+			t.Fatalf("%s: unexpected launch error. err=%s", test.name, err)
+		}
+		if state.Status != test.status {
+			t.Errorf("%s: expected status %s, got %s", test.name, test.status, state.Status)
+		}
+		if run.Result["key"] != "jobs:s1:eu" || run.Result["mode"] != test.mode {
+			t.Errorf("%s: unexpected run result %v", test.name, run.Result)
+		}
+		if test.err != nil {
+			if state.ReasonForIncompletion != test.err.Error() {
+				t.Errorf("%s: expected reason '%s', got '%s'", test.name, test.err, state.ReasonForIncompletion)
+			}
+			continue
+		}
+
+		if test.mode == "list" {
+			values := fake.List("jobs:s1:eu")
+			if len(values) == 0 || run.Result["length"] != int64(len(values)) {
+				t.Fatalf("%s: expected value pushed to list, got %d values and result %v", test.name, len(values), run.Result)
+			}
+			var value map[string]interface{}
+			err = json.Unmarshal(values[0], &value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value["region"] != "eu" || value["count"] != float64(i) || value["runId"] != run.WorkflowID || value["fireTime"] != "2019-01-02T03:00:00Z" || value["source"] != nil {
+				t.Errorf("%s: unexpected list value %v", test.name, value)
+			}
+			continue
+		}
+		entries := fake.Stream("jobs:s1:eu")
+		if len(entries) == 0 || run.Result["entryId"] == "" {
+			t.Fatalf("%s: expected entry added to stream, got %d entries and result %v", test.name, len(entries), run.Result)
+		}
+		entry := entries[len(entries)-1]
+		if entry.MaxLen != test.maxLen || entry.Approx != (test.maxLen > 0) {
+			t.Errorf("%s: expected maxLen %d approx=%t, got %d approx=%t", test.name, test.maxLen, test.maxLen > 0, entry.MaxLen, entry.Approx)
+		}
+		values := entry.Values.(map[string]interface{})
+		if values["region"] != "eu" || values["runId"] != run.WorkflowID || values["source"] != "schellar" {
+			t.Errorf("%s: unexpected stream entry %v", test.name, values)
+		}
+	}
+}
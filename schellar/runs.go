@@ -0,0 +1,221 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Run workflow instance launched for a schedule
+type Run struct {
+	WorkflowID      string                 `json:"workflowId" bson:"workflowId"`
+	ScheduleName    string                 `json:"scheduleName" bson:"scheduleName"`
+	WorkflowName    string                 `json:"workflowName" bson:"workflowName"`
+	WorkflowVersion int                    `json:"workflowVersion,omitempty" bson:"workflowVersion"`
+	Target          string                 `json:"target,omitempty" bson:"target,omitempty"`
+	Conductor       string                 `json:"conductor,omitempty" bson:"conductor,omitempty"`
+	Status          string                 `json:"status" bson:"status"`
+	CorrelationID   string                 `json:"correlationId,omitempty" bson:"correlationId,omitempty"`
+	RetryOf         string                 `json:"retryOf,omitempty" bson:"retryOf,omitempty"`
+	RetryAttempt    int                    `json:"retryAttempt,omitempty" bson:"retryAttempt,omitempty"`
+	FireTime        time.Time              `json:"fireTime" bson:"fireTime"`
+	StartDate       time.Time              `json:"startDate" bson:"startDate"`
+	EndDate         *time.Time             `json:"endDate,omitempty" bson:"endDate,omitempty"`
+	Output          map[string]interface{} `json:"output,omitempty" bson:"output,omitempty"`
+	//Result target specific details of the execution, like the response of webhooks
+	Result map[string]interface{} `json:"result,omitempty" bson:"result,omitempty"`
+	//Warned tells whether the run was already reported for exceeding checkWarningSeconds
+	Warned bool `json:"warned,omitempty" bson:"warned,omitempty"`
+}
+
+//ensureRunIndexes creates the indexes used to look up runs
+func ensureRunIndexes() error {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	err := rc.EnsureIndex(mgo.Index{Key: []string{"workflowId"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	return rc.EnsureIndex(mgo.Index{Key: []string{"scheduleName", "status"}})
+}
+
+//recordRun stores a run, updating any previous record for the same workflow id
+func recordRun(run Run) error {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	_, err := rc.Upsert(bson.M{"workflowId": run.WorkflowID}, bson.M{"$set": run})
+	return err
+}
+
+//recordRunResult stores the result of a run. It may be called before the run itself is recorded
+func recordRunResult(workflowID string, result map[string]interface{}) error {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	_, err := rc.Upsert(bson.M{"workflowId": workflowID}, bson.M{"$set": bson.M{"result": result}})
+	return err
+}
+
+//findRuns returns the runs of a schedule with the given status, oldest first. An empty status returns all runs
+func findRuns(scheduleName string, status string) ([]Run, error) {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	query := bson.M{"scheduleName": scheduleName}
+	if status != "" {
+		query["status"] = status
+	}
+	runs := make([]Run, 0)
+	err := rc.Find(query).Sort("startDate").All(&runs)
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+//markRunWarned records that a run was reported for exceeding checkWarningSeconds, so that it isn't reported again
+func markRunWarned(workflowID string) error {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	return rc.Update(bson.M{"workflowId": workflowID}, bson.M{"$set": bson.M{"warned": true}})
+}
+
+//lastRun returns the latest run of a schedule with the given status, or nil if there is none. An empty status
+//considers all runs
+func lastRun(scheduleName string, status string) (*Run, error) {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	query := bson.M{"scheduleName": scheduleName}
+	if status != "" {
+		query["status"] = status
+	}
+	var run Run
+	err := rc.Find(query).Sort("-startDate").One(&run)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+//getRun returns the run of a workflow id
+func getRun(workflowID string) (Run, error) {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	var run Run
+	err := rc.Find(bson.M{"workflowId": workflowID}).One(&run)
+	return run, err
+}
+
+//finishRun records the final status and output of a run
+func finishRun(run Run, status string, output map[string]interface{}) {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	rc := sc.DB(dbName).C("runs")
+
+	forgetFinishedRun(run.WorkflowID)
+	fields := bson.M{"status": status, "endDate": time.Now()}
+	if len(output) > 0 {
+		fields["output"] = output
+	}
+	err := rc.Update(bson.M{"workflowId": run.WorkflowID}, bson.M{"$set": fields})
+	if err != nil {
+		logrus.Errorf("Error updating run %s of schedule %s to status %s. err=%s", run.WorkflowID, run.ScheduleName, status, err)
+	}
+}
+
+//conductorClient returns the client of the Conductor cluster the run was launched on
+func (run Run) conductorClient() (ConductorClient, error) {
+	return getConductor(run.Conductor)
+}
+
+//executor returns the executor of the target the run was launched on
+func (run Run) executor() (Executor, error) {
+	return getExecutor(run.Target)
+}
+
+//getWorkflow gets the current state of the run from its executor. Finished runs return their recorded state
+func (run Run) getWorkflow() (*Workflow, error) {
+	if wf, exists := finishedRunState(run.WorkflowID); exists {
+		return wf, nil
+	}
+	if run.Status != "RUNNING" {
+		return run.recordedState(), nil
+	}
+	executor, err := run.executor()
+	if err != nil {
+		return nil, err
+	}
+	return executor.Status(run)
+}
+
+//recordedState returns the state of a finished run as recorded in the runs collection
+func (run Run) recordedState() *Workflow {
+	wf := &Workflow{
+		WorkflowID: run.WorkflowID,
+		Status:     run.Status,
+		Output:     run.Output,
+		StartTime:  run.StartDate.UnixNano() / int64(time.Millisecond),
+	}
+	if run.EndDate != nil {
+		wf.EndTime = run.EndDate.UnixNano() / int64(time.Millisecond)
+	}
+	return wf
+}
+
+//terminate cancels the run on its executor and returns its resulting state
+func (run Run) terminate(reason string) (*Workflow, error) {
+	executor, err := run.executor()
+	if err != nil {
+		return nil, err
+	}
+	err = executor.Cancel(run, reason)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Schedule %s: Workflow %s terminated. reason=%s", run.ScheduleName, run.WorkflowID, reason)
+	wf, err := run.getWorkflow()
+	if err != nil || !isWorkflowFinished(wf.Status) {
+		//it was terminated anyway, but may still be stopping. Output will be missing
+		wf = &Workflow{WorkflowID: run.WorkflowID, Status: "TERMINATED"}
+	}
+	return wf, nil
+}
+
+//terminateRuns terminates all running workflows of a schedule. Returns the terminated workflows by workflow id
+func terminateRuns(scheduleName string, reason string) (map[string]*Workflow, error) {
+	terminated := make(map[string]*Workflow)
+	runs, err := findRuns(scheduleName, "RUNNING")
+	if err != nil {
+		return terminated, err
+	}
+	for _, run := range runs {
+		wf, err := run.terminate(reason)
+		if err != nil {
+			return terminated, err
+		}
+		terminated[run.WorkflowID] = wf
+	}
+	return terminated, nil
+}
+
+//isWorkflowFinished tells whether a Conductor workflow status is final
+func isWorkflowFinished(status string) bool {
+	return status != "RUNNING" && status != "PAUSED"
+}
@@ -2,23 +2,32 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	scheduledRoutineHashes = make(map[string]*cron.Cron)
+	//serializes run status processing between the polling loop and completion callbacks
+	runStatusMutex sync.Mutex
 )
 
 func startScheduler() error {
-	err := prepareTimers()
+	err := ensureRunIndexes()
+	if err != nil {
+		return err
+	}
+	err = prepareTimers()
 	if err != nil {
 		return err
 	}
 	go checkRunningWorkflows()
+	go replayPendingTriggers()
 	return nil
 }
 
@@ -88,8 +97,14 @@ func launchSchedule(scheduleName string) error {
 
 	c := cron.New()
 	logrus.Infof("Schedule %s: Creating timer. cron=%s. workflow=%s", schedule0.Name, schedule0.CronString, schedule0.WorkflowName)
-	c.AddFunc(schedule0.CronString, func() {
+	var entryID cron.EntryID
+	entryID, _ = c.AddFunc(schedule0.CronString, func() {
 		logrus.Debugf("Processing timer trigger for schedule %s", scheduleName)
+		//the time the trigger was scheduled for, even if the job started a little later
+		fireTime := c.Entry(entryID).Prev
+		if fireTime.IsZero() {
+			fireTime = time.Now()
+		}
 		sc := mongoSession.Copy()
 		defer sc.Close()
 
@@ -110,48 +125,19 @@ func launchSchedule(scheduleName string) error {
 			isAfter = true
 		}
 		if isBefore && isAfter {
-
-			runningWorkflows, err2 := findWorkflows(schedule.WorkflowName, schedule.Name, true)
-			if err2 != nil {
-				logrus.Errorf("Error finding currently running workflows. err=%s", err2)
+			if !targetAvailable(schedule) {
+				logrus.Warnf("Schedule %s: Conductor is unavailable. Storing trigger for later replay", scheduleName)
+				enqueuePendingTrigger(scheduleName, fireTime, errCircuitOpen)
 				return
 			}
-
-			runningTotalHits := int(runningWorkflows["totalHits"].(float64))
-
-			scheduleStatus := "RUNNING"
-			if runningTotalHits > 0 {
-				if !schedule.ParallelRuns {
-					wresults := runningWorkflows["results"]
-					if wresults != nil {
-						wf0 := wresults.([]interface{})[0]
-						wf1 := wf0.(map[string]interface{})
-						workflowID := wf1["workflowId"]
-						logrus.Debugf("Schedule %s trigger skipped. Previous workflow id (%s) has not finished yet", schedule.Name, workflowID)
-						return
-					}
-				}
-				logrus.Infof("Schedule %s: Launching concurrent workflow (%s). count=%d", schedule.Name, schedule.WorkflowName, runningTotalHits)
-			}
-
-			logrus.Debugf("Launching workflow '%s' for schedule '%s'", schedule.WorkflowName, scheduleName)
-			err := launchWorkflow(scheduleName)
-			if err != nil {
-				logrus.Errorf("Error launching Workflow err=%s", err)
+			err := startScheduledRun(schedule, Trigger{FireTime: fireTime})
+			if err == errLaunchThrottled {
 				return
 			}
-
-			logrus.Debugf("Updating Schedule status. name=%s. status=%s", scheduleName, "RUNNING")
-			statusMap := make(map[string]interface{})
-			statusMap["status"] = scheduleStatus
-			statusMap["lastUpdate"] = time.Now()
-
-			sr := sc.DB(dbName).C("schedules")
-			err0 := sr.Update(bson.M{"name": scheduleName}, bson.M{"$set": statusMap})
-			if err0 != nil {
-				logrus.Errorf("Error saving Schedule status err=%s", err0)
+			if err != nil {
+				logrus.Errorf("Error launching Workflow for schedule %s. Storing trigger for later replay. err=%s", scheduleName, err)
+				enqueuePendingTrigger(scheduleName, fireTime, err)
 			}
-
 		} else {
 			logrus.Debugf("Schedule %s active, but not within activation date", scheduleName)
 		}
@@ -163,10 +149,157 @@ func launchSchedule(scheduleName string) error {
 	return nil
 }
 
+//startScheduledRun launches a new workflow instance for a timer trigger of the schedule, unless
+//parallel runs are disabled and there is a workflow instance still running. The skip check comes
+//first so that skipped triggers don't consume rate limit tokens
+func startScheduledRun(schedule Schedule, trigger Trigger) error {
+	if !schedule.ParallelRuns {
+		running, err2 := runningWorkflowIDs(schedule)
+		if err2 != nil {
+			return fmt.Errorf("Error finding currently running workflows. err=%s", err2)
+		}
+		if len(running) > 0 {
+			logrus.Debugf("Schedule %s trigger skipped. Previous workflow id (%s) has not finished yet", schedule.Name, running[0])
+			return nil
+		}
+	}
+
+	logrus.Debugf("Launching workflow '%s' for schedule '%s'", schedule.WorkflowName, schedule.Name)
+	var run Run
+	var state *Workflow
+	err := dispatchLaunch(schedule, true, func() error {
+		var err error
+		run, state, err = launchRun(schedule.Name, trigger)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("Updating Schedule status. name=%s. status=%s", schedule.Name, "RUNNING")
+	statusMap := make(map[string]interface{})
+	statusMap["status"] = "RUNNING"
+	statusMap["lastWorkflowId"] = run.WorkflowID
+	statusMap["lastUpdate"] = time.Now()
+
+	//a new timer run supersedes pending retries of previous runs
+	retryMap := make(map[string]interface{})
+	retryMap["retryCount"] = ""
+	retryMap["retryOf"] = ""
+	retryMap["nextRetryDate"] = ""
+
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	sr := sc.DB(dbName).C("schedules")
+	err0 := sr.Update(bson.M{"name": schedule.Name}, bson.M{"$set": statusMap, "$unset": retryMap})
+	if err0 != nil {
+		logrus.Errorf("Error saving Schedule status err=%s", err0)
+	}
+	if state != nil {
+		checkScheduleRuns(schedule.Name, map[string]*Workflow{run.WorkflowID: state})
+	}
+	return nil
+}
+
+//runningWorkflowIDs returns the ids of the workflows launched for the schedule that are still running in Conductor
+func runningWorkflowIDs(schedule Schedule) ([]string, error) {
+	runs, err := findRuns(schedule.Name, "RUNNING")
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 && schedule.Status == "RUNNING" {
+		runs, err = recoverRuns(schedule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]string, 0)
+	for _, run := range runs {
+		wf, err := run.getWorkflow()
+		if err != nil {
+			return nil, err
+		}
+		if !isWorkflowFinished(wf.Status) {
+			ids = append(ids, run.WorkflowID)
+		}
+	}
+	return ids, nil
+}
+
+//recoverRuns is used when a schedule is RUNNING but has no running runs (for example, when the run couldn't be
+//recorded after launch or schellar stopped before updating the schedule). The last run of the schedule is checked
+//through its executor. If it wasn't recorded, Conductor is searched for workflows of the schedule and other targets
+//start tracking it by its id
+func recoverRuns(schedule Schedule) ([]Run, error) {
+	if schedule.LastWorkflowID != "" {
+		run, err := getRun(schedule.LastWorkflowID)
+		if err == nil {
+			return []Run{run}, nil
+		}
+		if err != mgo.ErrNotFound {
+			return nil, err
+		}
+	}
+	if schedule.targetType() != conductorTarget {
+		if schedule.LastWorkflowID == "" {
+			return []Run{}, nil
+		}
+		logrus.Infof("Schedule %s: Last run %s wasn't recorded. Tracking it", schedule.Name, schedule.LastWorkflowID)
+		run := Run{
+			WorkflowID:   schedule.LastWorkflowID,
+			ScheduleName: schedule.Name,
+			WorkflowName: schedule.WorkflowName,
+			Target:       schedule.targetType(),
+			Status:       "RUNNING",
+			StartDate:    time.Now(),
+		}
+		err := recordRun(run)
+		if err != nil {
+			return nil, err
+		}
+		return []Run{run}, nil
+	}
+	logrus.Infof("Schedule %s: No tracked runs. Searching Conductor for its workflows", schedule.Name)
+	client, err := getConductor(schedule.Conductor)
+	if err != nil {
+		return nil, err
+	}
+	result, err := client.SearchWorkflows(WorkflowSearch{WorkflowType: schedule.WorkflowName, ScheduleName: schedule.Name, Running: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Results) == 0 {
+		result, err = client.SearchWorkflows(WorkflowSearch{WorkflowType: schedule.WorkflowName, ScheduleName: schedule.Name, Running: false, Size: 1})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	runs := make([]Run, 0)
+	for _, wf := range result.Results {
+		run := Run{
+			WorkflowID:      wf.WorkflowID,
+			ScheduleName:    schedule.Name,
+			WorkflowName:    schedule.WorkflowName,
+			WorkflowVersion: wf.Version,
+			Conductor:       schedule.Conductor,
+			Status:          "RUNNING",
+			StartDate:       time.Now(),
+		}
+		err := recordRun(run)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
 func checkRunningWorkflows() {
 	logrus.Debugf("Starting to check running workflow status")
 	for {
 		startTime := time.Now()
+		launchPendingRetries()
 		sc := mongoSession.Copy()
 		sch := sc.DB(dbName).C("schedules")
 		schedules := make([]Schedule, 0)
@@ -181,77 +314,267 @@ func checkRunningWorkflows() {
 			logrus.Debugf("Checking running workflows on Conductor...")
 		}
 		for _, schedule := range schedules {
-			runningWorkflows, err := findWorkflows(schedule.WorkflowName, schedule.Name, true)
-			if err != nil {
-				logrus.Errorf("Error finding workflows for schedule %s. err=%s", schedule.Name, err)
-				continue
-			}
-			finishedWorkflows, err := findWorkflows(schedule.WorkflowName, schedule.Name, false)
+			checkScheduleRuns(schedule.Name, nil)
+		}
+
+		elapsedTime := time.Now().Sub(startTime)
+		remainingSleep := float64(checkIntervalSeconds) - elapsedTime.Seconds()
+		if remainingSleep > 0 {
+			logrus.Debugf("Sleeping for %d seconds...", int(remainingSleep))
+			time.Sleep(time.Duration(remainingSleep) * time.Second)
+		}
+	}
+}
+
+//checkScheduleRuns gets the status of the tracked runs of a RUNNING schedule from Conductor and updates the schedule accordingly.
+//Workflows in reported (by workflow id) were already notified to schellar and are not fetched from Conductor
+func checkScheduleRuns(scheduleName string, reported map[string]*Workflow) {
+	runStatusMutex.Lock()
+	defer runStatusMutex.Unlock()
+
+	sc0 := mongoSession.Copy()
+	var schedule Schedule
+	err := sc0.DB(dbName).C("schedules").Find(bson.M{"name": scheduleName}).One(&schedule)
+	sc0.Close()
+	if err != nil {
+		logrus.Errorf("Couldn't get schedule %s. err=%s", scheduleName, err)
+		return
+	}
+	if schedule.Status != "RUNNING" {
+		logrus.Debugf("Schedule %s is not RUNNING anymore. status=%s", scheduleName, schedule.Status)
+		return
+	}
+
+	runs, err := findRuns(schedule.Name, "RUNNING")
+	if err != nil {
+		logrus.Errorf("Error finding runs for schedule %s. err=%s", schedule.Name, err)
+		return
+	}
+	if len(runs) == 0 {
+		runs, err = recoverRuns(schedule)
+		if err != nil {
+			logrus.Errorf("Error finding workflows for schedule %s. err=%s", schedule.Name, err)
+			return
+		}
+		if len(runs) == 0 {
+			logrus.Errorf("No workflows found for schedule %s, but it is in state RUNNING", schedule.Name)
+			return
+		}
+	}
+
+	running := make([]runningWorkflow, 0)
+	pending := 0
+	var lastFinished *Workflow
+	for _, run := range runs {
+		wf, exists := reported[run.WorkflowID]
+		if !exists {
+			wf, err = run.getWorkflow()
 			if err != nil {
-				logrus.Errorf("Error finding workflows for schedule %s. err=%s", schedule.Name, err)
+				logrus.Errorf("Could not get workflow instance. err=%s", err)
+				pending++
 				continue
 			}
-			runningTotalHits := int(runningWorkflows["totalHits"].(float64))
-			finishedTotalHits := int(finishedWorkflows["totalHits"].(float64))
-
-			logrus.Debugf("Running workflows hits for schedule %s: %d", schedule.Name, runningTotalHits)
-			logrus.Debugf("Finished workflows hits for schedule %s: %d", schedule.Name, finishedTotalHits)
-
-			scheduleStatus := "RUNNING"
-			var wfoutput map[string]interface{}
-			if runningTotalHits == 0 {
-				if finishedTotalHits == 0 {
-					logrus.Errorf("No workflows found for schedule %s, but it is in state RUNNING", schedule.Name)
-					continue
-				} else {
-					wf0 := finishedWorkflows["results"].([]interface{})[0]
-					wf1 := wf0.(map[string]interface{})
-					wf2, err := getWorkflowInstance(wf1["workflowId"].(string))
-					if err != nil {
-						logrus.Errorf("Could not get workflow instance. err=%s", err)
-						continue
-					}
-					scheduleStatus = wf2["status"].(string)
-					out, exists := wf2["output"]
-					if exists {
-						wfoutput = out.(map[string]interface{})
-					}
-				}
-			}
+		}
+		if !isWorkflowFinished(wf.Status) {
+			running = append(running, runningWorkflow{run: run, workflow: wf})
+			continue
+		}
+		logrus.Debugf("Schedule %s: Workflow %s finished with status %s", schedule.Name, run.WorkflowID, wf.Status)
+		if run.Status == "RUNNING" {
+			finishRun(run, wf.Status, wf.Output)
+		}
+		lastFinished = wf
+	}
+	logrus.Debugf("Running workflows for schedule %s: %d", schedule.Name, len(running))
+
+	scheduleStatus := "RUNNING"
+	var wfoutput map[string]interface{}
+	finishedWorkflowID := ""
+	timedOut, warning := checkRunDurations(schedule, running)
+	for _, run := range runs {
+		if timedOut[run.WorkflowID] {
+			finishRun(run, "TIMED_OUT", nil)
+		}
+	}
+	if pending+len(running)-len(timedOut) == 0 {
+		if len(timedOut) > 0 {
+			scheduleStatus = "TIMED_OUT"
+		} else if lastFinished != nil {
+			finishedWorkflowID = lastFinished.WorkflowID
+			scheduleStatus = lastFinished.Status
+			wfoutput = lastFinished.Output
+		}
+	}
 
-			logrus.Debugf("Schedule status is %s", scheduleStatus)
-			sc := mongoSession.Copy()
-			sch := sc.DB(dbName).C("schedules")
-			scheduleMap := make(map[string]interface{})
-			scheduleMap["status"] = scheduleStatus
-			scheduleMap["lastUpdate"] = time.Now()
-
-			if len(wfoutput) > 0 {
-				logrus.Debugf("Merging workflow output to schedule context. output=%s", wfoutput)
-				m := schedule.WorkflowContext
-				for k, v := range wfoutput {
-					m[k] = v
-				}
-				scheduleMap["workflowContext"] = m
+	logrus.Debugf("Schedule status is %s", scheduleStatus)
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	sch := sc.DB(dbName).C("schedules")
+	scheduleMap := make(map[string]interface{})
+	scheduleMap["status"] = scheduleStatus
+	scheduleMap["lastUpdate"] = time.Now()
+	scheduleMap["warning"] = warning
+	unsetMap := make(map[string]interface{})
+
+	if scheduleStatus == "FAILED" && schedule.RetryPolicy != nil && schedule.RetryCount < schedule.RetryPolicy.MaxRetries {
+		retryOf := schedule.RetryOf
+		if retryOf == "" {
+			retryOf = finishedWorkflowID
+		}
+		nextRetryDate := time.Now().Add(schedule.RetryPolicy.Backoff(schedule.RetryCount + 1))
+		logrus.Infof("Schedule %s: Workflow %s failed. Retry %d/%d will be launched at %s", schedule.Name, finishedWorkflowID, schedule.RetryCount+1, schedule.RetryPolicy.MaxRetries, nextRetryDate)
+		scheduleStatus = "WAITING_RETRY"
+		scheduleMap["status"] = scheduleStatus
+		scheduleMap["retryOf"] = retryOf
+		scheduleMap["nextRetryDate"] = nextRetryDate
+	}
+
+	if len(wfoutput) > 0 {
+		logrus.Debugf("Merging workflow output to schedule context. output=%s", wfoutput)
+		m := schedule.WorkflowContext
+		if m == nil {
+			m = make(map[string]interface{})
+		}
+		for k, v := range wfoutput {
+			m[k] = v
+			//outputs replace the templates of the schedule, but are never rendered themselves
+			if _, exists := schedule.ContextTemplates[k]; exists {
+				unsetMap["contextTemplates."+k] = ""
 			}
+		}
+		scheduleMap["workflowContext"] = m
+	}
+
+	update := bson.M{"$set": scheduleMap}
+	if len(unsetMap) > 0 {
+		update["$unset"] = unsetMap
+	}
+	err0 := sch.Update(bson.M{"name": schedule.Name}, update)
+	if scheduleStatus != schedule.Status {
+		logrus.Infof("Schedule %s: Changing status to %s", schedule.Name, scheduleStatus)
+	}
+	if err0 != nil {
+		logrus.Errorf("Error updating schedule %s to status %s. err=%s", schedule.Name, scheduleStatus, err0)
+	}
+}
+
+//launchPendingRetries launches new workflow instances for schedules whose failed runs are waiting for a retry
+func launchPendingRetries() {
+	sc := mongoSession.Copy()
+	defer sc.Close()
+	st := sc.DB(dbName).C("schedules")
 
-			err0 = sch.Update(bson.M{"name": schedule.Name}, bson.M{"$set": scheduleMap})
-			if scheduleStatus != schedule.Status {
-				logrus.Infof("Schedule %s: Changing status to %s", schedule.Name, scheduleStatus)
+	schedules := make([]Schedule, 0)
+	err := st.Find(bson.M{"status": "WAITING_RETRY", "nextRetryDate": bson.M{"$lte": time.Now()}}).All(&schedules)
+	if err != nil {
+		logrus.Errorf("Error getting schedules waiting for retry. err=%s", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		if !targetAvailable(schedule) {
+			logrus.Debugf("Schedule %s: Conductor is unavailable. Postponing retry", schedule.Name)
+			continue
+		}
+		attempt := schedule.RetryCount + 1
+		logrus.Infof("Schedule %s: Launching retry %d of workflow %s", schedule.Name, attempt, schedule.RetryOf)
+		//retries are launched for the time of the failed run, so that its templates render the same values
+		fireTime := time.Now()
+		original, err := getRun(schedule.RetryOf)
+		if err == nil && !original.FireTime.IsZero() {
+			fireTime = original.FireTime
+		}
+		var run Run
+		var state *Workflow
+		//retries are launched from the status check loop, which must not wait for rate limits
+		err = dispatchLaunch(schedule, false, func() error {
+			var err error
+			run, state, err = launchRun(schedule.Name, Trigger{FireTime: fireTime, RetryOf: schedule.RetryOf, RetryAttempt: attempt})
+			return err
+		})
+		if err == errLaunchThrottled {
+			logrus.Debugf("Schedule %s: Retry postponed by rate limit until the next check", schedule.Name)
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Error launching retry for schedule %s. err=%s", schedule.Name, err)
+			continue
+		}
+		workflowRetriesCounter.WithLabelValues(schedule.Name).Inc()
+
+		statusMap := make(map[string]interface{})
+		statusMap["status"] = "RUNNING"
+		statusMap["retryCount"] = attempt
+		statusMap["lastWorkflowId"] = run.WorkflowID
+		statusMap["lastUpdate"] = time.Now()
+		err = st.Update(bson.M{"name": schedule.Name}, bson.M{"$set": statusMap, "$unset": bson.M{"nextRetryDate": ""}})
+		if err != nil {
+			logrus.Errorf("Error saving Schedule status err=%s", err)
+		}
+		if state != nil {
+			checkScheduleRuns(schedule.Name, map[string]*Workflow{run.WorkflowID: state})
+		}
+	}
+}
+
+//runningWorkflow a tracked run whose workflow is still running in Conductor
+type runningWorkflow struct {
+	run      Run
+	workflow *Workflow
+}
+
+//checkRunDurations verifies how long the running workflows of a schedule have been running. Workflows exceeding
+//checkWarningSeconds are reported once (runs remember they were reported) and workflows exceeding maxRunDurationSeconds are terminated.
+//Returns the ids of the terminated workflows and the current warning message for the schedule, if any
+func checkRunDurations(schedule Schedule, running []runningWorkflow) (map[string]bool, string) {
+	checkWarning := time.Duration(schedule.CheckWarningSeconds) * time.Second
+	maxRunDuration := time.Duration(schedule.MaxRunDurationSeconds) * time.Second
+
+	warning := ""
+	terminated := make(map[string]bool)
+	for _, r := range running {
+		workflowID := r.workflow.WorkflowID
+		startTime, ok := r.workflow.StartDate()
+		if !ok {
+			logrus.Warnf("Couldn't determine start time of workflow %s", workflowID)
+			continue
+		}
+		elapsed := time.Since(startTime)
+
+		if maxRunDuration > 0 && elapsed > maxRunDuration {
+			logrus.Warnf("Schedule %s: Workflow %s running for %s, exceeding maxRunDurationSeconds=%d. Terminating it", schedule.Name, workflowID, elapsed.Round(time.Second), schedule.MaxRunDurationSeconds)
+			executor, err := r.run.executor()
+			if err != nil {
+				logrus.Errorf("Error terminating workflow %s. err=%s", workflowID, err)
+				continue
 			}
-			sc.Close()
-			if err0 != nil {
-				logrus.Errorf("Error updating schedule %s to status %s. err=%s", schedule.Name, scheduleStatus, err0)
+			err = executor.Cancel(r.run, fmt.Sprintf("Terminated by schellar. Schedule %s exceeded maxRunDurationSeconds=%d", schedule.Name, schedule.MaxRunDurationSeconds))
+			if err != nil {
+				logrus.Errorf("Error terminating workflow %s. err=%s", workflowID, err)
+				continue
 			}
+			terminated[workflowID] = true
+			continue
 		}
 
-		elapsedTime := time.Now().Sub(startTime)
-		remainingSleep := float64(checkIntervalSeconds) - elapsedTime.Seconds()
-		if remainingSleep > 0 {
-			logrus.Debugf("Sleeping for %d seconds...", int(remainingSleep))
-			time.Sleep(time.Duration(remainingSleep) * time.Second)
+		if checkWarning > 0 && elapsed > checkWarning {
+			warning = fmt.Sprintf("Workflow %s running for %s, exceeding checkWarningSeconds=%d", workflowID, elapsed.Round(time.Second), int(checkWarning.Seconds()))
+			if !r.run.Warned {
+				logrus.Warnf("Schedule %s: %s", schedule.Name, warning)
+				checkWarningsCounter.WithLabelValues(schedule.Name).Inc()
+				emitEvent("CHECK_WARNING", schedule.Name, warning, map[string]interface{}{
+					"workflowId":     workflowID,
+					"workflowName":   schedule.WorkflowName,
+					"runningSeconds": int(elapsed.Seconds()),
+				})
+				err := markRunWarned(r.run.WorkflowID)
+				if err != nil {
+					logrus.Errorf("Couldn't record warning of run %s. err=%s", r.run.WorkflowID, err)
+				}
+			}
 		}
 	}
+	return terminated, warning
 }
 
 func getStringValue(m map[string]interface{}, keyName string, defaultValue string) string {
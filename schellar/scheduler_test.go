@@ -0,0 +1,321 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//setupScheduler prepares an empty test database and a fake Conductor as the 'default' cluster.
+//Tests that need MongoDB are skipped if MONGO_ADDRESS is not defined
+func setupScheduler(t *testing.T) *fakeConductorClient {
+	address := os.Getenv("MONGO_ADDRESS")
+	if address == "" {
+		t.Skip("MONGO_ADDRESS not defined")
+	}
+	if mongoSession == nil {
+		ms, err := mgo.DialWithInfo(&mgo.DialInfo{Addrs: []string{address}, Timeout: 2 * time.Second})
+		if err != nil {
+			t.Fatalf("Couldn't connect to MongoDB. err=%s", err)
+		}
+		mongoSession = ms
+	}
+	dbName = "schellar_test"
+	err := mongoSession.DB(dbName).DropDatabase()
+	if err != nil {
+		t.Fatalf("Couldn't clean test database. err=%s", err)
+	}
+	err = ensureRunIndexes()
+	if err != nil {
+		t.Fatalf("Couldn't create indexes. err=%s", err)
+	}
+	conductor := newFakeConductorClient()
+	conductors = map[string]ConductorClient{defaultConductorName: conductor}
+	return conductor
+}
+
+func createTestSchedule(t *testing.T, schedule Schedule) Schedule {
+	schedule.Enabled = true
+	if schedule.CronString == "" {
+		schedule.CronString = "0 0 * * *"
+	}
+	err := schedule.ValidateAndUpdate()
+	if err != nil {
+		t.Fatalf("Invalid schedule. err=%s", err)
+	}
+	err = mongoSession.DB(dbName).C("schedules").Insert(schedule)
+	if err != nil {
+		t.Fatalf("Couldn't create schedule. err=%s", err)
+	}
+	return schedule
+}
+
+func loadTestSchedule(t *testing.T, name string) Schedule {
+	var schedule Schedule
+	err := mongoSession.DB(dbName).C("schedules").Find(bson.M{"name": name}).One(&schedule)
+	if err != nil {
+		t.Fatalf("Couldn't get schedule %s. err=%s", name, err)
+	}
+	return schedule
+}
+
+func runningTestRun(t *testing.T, scheduleName string) Run {
+	runs, err := findRuns(scheduleName, "RUNNING")
+	if err != nil {
+		t.Fatalf("Couldn't find runs. err=%s", err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("Expected 1 running run, found %d", len(runs))
+	}
+	return runs[0]
+}
+
+func TestStartScheduledRun(t *testing.T) {
+	conductor := setupScheduler(t)
+	conductor.PutWorkflowDef(WorkflowDef{Name: "encode", Version: 1})
+	conductor.PutWorkflowDef(WorkflowDef{Name: "encode", Version: 2})
+	schedule := createTestSchedule(t, Schedule{
+		Name:            "s1",
+		WorkflowName:    "encode",
+		WorkflowVersion: "latest",
+		WorkflowContext: map[string]interface{}{"lastDate": "2019-01-01"},
+	})
+
+	fireTime := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	err := startScheduledRun(schedule, Trigger{FireTime: fireTime})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+
+	run := runningTestRun(t, "s1")
+	if run.WorkflowVersion != 2 {
+		t.Errorf("Expected latest workflow version 2, got %d", run.WorkflowVersion)
+	}
+	if !run.FireTime.Equal(fireTime) {
+		t.Errorf("Expected fire time %s, got %s", fireTime, run.FireTime)
+	}
+	wf, err := conductor.GetWorkflow(run.WorkflowID)
+	if err != nil {
+		t.Fatalf("Workflow not launched. err=%s", err)
+	}
+	if wf.Input["lastDate"] != "2019-01-01" || wf.Input["scheduleName"] != "s1" {
+		t.Errorf("Unexpected workflow input %v", wf.Input)
+	}
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "RUNNING" || schedule.LastWorkflowID != run.WorkflowID {
+		t.Errorf("Expected schedule RUNNING with last workflow %s, got %s %s", run.WorkflowID, schedule.Status, schedule.LastWorkflowID)
+	}
+
+	//parallelRuns is false, so triggers are skipped while the workflow runs
+	err = startScheduledRun(schedule, Trigger{FireTime: fireTime.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Trigger failed. err=%s", err)
+	}
+	if len(conductor.workflows) != 1 {
+		t.Errorf("Expected trigger to be skipped, but %d workflows were launched", len(conductor.workflows))
+	}
+}
+
+func TestCheckScheduleRunsMergesOutput(t *testing.T) {
+	conductor := setupScheduler(t)
+	schedule := createTestSchedule(t, Schedule{
+		Name:            "s1",
+		WorkflowName:    "encode",
+		WorkflowContext: map[string]interface{}{"lastDate": "2019-01-01", "bucket": "videos"},
+	})
+	err := startScheduledRun(schedule, Trigger{FireTime: time.Now()})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	run := runningTestRun(t, "s1")
+
+	checkScheduleRuns("s1", nil)
+	if loadTestSchedule(t, "s1").Status != "RUNNING" {
+		t.Fatalf("Expected schedule to keep RUNNING while the workflow runs")
+	}
+
+	err = conductor.FinishWorkflow(run.WorkflowID, "COMPLETED", map[string]interface{}{"lastDate": "2019-01-15"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScheduleRuns("s1", nil)
+
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "COMPLETED" {
+		t.Errorf("Expected schedule COMPLETED, got %s", schedule.Status)
+	}
+	if schedule.WorkflowContext["lastDate"] != "2019-01-15" || schedule.WorkflowContext["bucket"] != "videos" {
+		t.Errorf("Expected output merged to workflowContext, got %v", schedule.WorkflowContext)
+	}
+	run, err = getRun(run.WorkflowID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != "COMPLETED" || run.EndDate == nil {
+		t.Errorf("Expected run COMPLETED with end date, got %s %v", run.Status, run.EndDate)
+	}
+}
+
+func TestFailedRunIsRetried(t *testing.T) {
+	conductor := setupScheduler(t)
+	schedule := createTestSchedule(t, Schedule{
+		Name:         "s1",
+		WorkflowName: "encode",
+		RetryPolicy:  &RetryPolicy{MaxRetries: 1},
+	})
+	fireTime := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	err := startScheduledRun(schedule, Trigger{FireTime: fireTime})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	failed := runningTestRun(t, "s1")
+	conductor.FinishWorkflow(failed.WorkflowID, "FAILED", nil)
+	checkScheduleRuns("s1", nil)
+
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "WAITING_RETRY" || schedule.RetryOf != failed.WorkflowID {
+		t.Fatalf("Expected schedule WAITING_RETRY for %s, got %s %s", failed.WorkflowID, schedule.Status, schedule.RetryOf)
+	}
+
+	//skip the backoff
+	err = mongoSession.DB(dbName).C("schedules").Update(bson.M{"name": "s1"}, bson.M{"$set": bson.M{"nextRetryDate": time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	launchPendingRetries()
+	retry := runningTestRun(t, "s1")
+	if retry.WorkflowID == failed.WorkflowID || retry.RetryOf != failed.WorkflowID || retry.RetryAttempt != 1 {
+		t.Fatalf("Unexpected retry run %+v", retry)
+	}
+	if !retry.FireTime.Equal(fireTime) {
+		t.Errorf("Expected retry to keep fire time %s, got %s", fireTime, retry.FireTime)
+	}
+	wf, _ := conductor.GetWorkflow(retry.WorkflowID)
+	if wf.Input["retryOf"] != failed.WorkflowID || wf.Input["retryAttempt"] != 1 {
+		t.Errorf("Expected retry input, got %v", wf.Input)
+	}
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "RUNNING" || schedule.RetryCount != 1 {
+		t.Errorf("Expected schedule RUNNING with retryCount 1, got %s %d", schedule.Status, schedule.RetryCount)
+	}
+
+	//no retries left
+	conductor.FinishWorkflow(retry.WorkflowID, "FAILED", nil)
+	checkScheduleRuns("s1", nil)
+	if status := loadTestSchedule(t, "s1").Status; status != "FAILED" {
+		t.Errorf("Expected schedule FAILED after the last retry, got %s", status)
+	}
+}
+
+func TestValidateWorkflow(t *testing.T) {
+	conductor := newFakeConductorClient()
+	conductors = map[string]ConductorClient{defaultConductorName: conductor}
+	conductor.PutWorkflowDef(WorkflowDef{Name: "encode", Version: 1, InputParameters: []string{"lastDate"}})
+
+	schedule := Schedule{WorkflowName: "encode", WorkflowVersion: "1", WorkflowContext: map[string]interface{}{"lastDate": "", "other": ""}}
+	warnings, err := schedule.ValidateWorkflow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("Expected a warning about 'other', got %v", warnings)
+	}
+
+	schedule.WorkflowVersion = "2"
+	_, err = schedule.ValidateWorkflow()
+	if err == nil {
+		t.Errorf("Expected undefined workflow version to be invalid")
+	}
+}
+
+func TestRecoverFinishedRun(t *testing.T) {
+	conductor := setupScheduler(t)
+	schedule := createTestSchedule(t, Schedule{Name: "s1", WorkflowName: "encode"})
+	err := startScheduledRun(schedule, Trigger{FireTime: time.Now()})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	run := runningTestRun(t, "s1")
+	conductor.FinishWorkflow(run.WorkflowID, "COMPLETED", map[string]interface{}{"lastDate": "2019-01-15"})
+	//schellar stopped after recording the run, but before updating the schedule
+	finishRun(run, "COMPLETED", map[string]interface{}{"lastDate": "2019-01-15"})
+
+	checkScheduleRuns("s1", nil)
+	schedule = loadTestSchedule(t, "s1")
+	if schedule.Status != "COMPLETED" || schedule.WorkflowContext["lastDate"] != "2019-01-15" {
+		t.Errorf("Expected schedule COMPLETED with the run output, got %s %v", schedule.Status, schedule.WorkflowContext)
+	}
+}
+
+func TestRecoverUnrecordedRun(t *testing.T) {
+	setupScheduler(t)
+	createTestSchedule(t, Schedule{
+		Name:   "s1",
+		Target: &Target{Type: webhookTarget, Webhook: &WebhookTarget{URL: "http://example.com/jobs"}},
+	})
+	//the run was launched, but schellar stopped before recording it
+	err := mongoSession.DB(dbName).C("schedules").Update(bson.M{"name": "s1"}, bson.M{"$set": bson.M{"status": "RUNNING", "lastWorkflowId": "lost-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkScheduleRuns("s1", nil)
+	if status := loadTestSchedule(t, "s1").Status; status != "FAILED" {
+		t.Errorf("Expected schedule FAILED, got %s", status)
+	}
+	run, err := getRun("lost-1")
+	if err != nil {
+		t.Fatalf("Expected run to be tracked. err=%s", err)
+	}
+	if run.Status != "FAILED" || run.Target != webhookTarget {
+		t.Errorf("Unexpected run %+v", run)
+	}
+}
+
+func TestOutputsAreNotRenderedAsTemplates(t *testing.T) {
+	conductor := setupScheduler(t)
+	schedule := createTestSchedule(t, Schedule{
+		Name:         "s1",
+		WorkflowName: "encode",
+		WorkflowContext: map[string]interface{}{
+			"day":      "{{formatTime \"2006-01-02\" .FireTime}}",
+			"window":   map[string]interface{}{"to": "{{formatTime \"2006-01-02\" .FireTime}}"},
+			"lastDate": "2019-01-01",
+		},
+	})
+	fireTime := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	err := startScheduledRun(schedule, Trigger{FireTime: fireTime})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	run := runningTestRun(t, "s1")
+	wf, _ := conductor.GetWorkflow(run.WorkflowID)
+	if wf.Input["day"] != "2019-01-02" || wf.Input["lastDate"] != "2019-01-01" {
+		t.Fatalf("Expected templates rendered with the fire time, got %v", wf.Input)
+	}
+
+	//the workflow output replaces 'day' and contains template markers, which must be passed as is
+	conductor.FinishWorkflow(run.WorkflowID, "COMPLETED", map[string]interface{}{"day": "fixed", "lastDate": "{{.Now}}"})
+	checkScheduleRuns("s1", nil)
+	schedule = loadTestSchedule(t, "s1")
+	if _, exists := schedule.ContextTemplates["day"]; exists {
+		t.Errorf("Expected template 'day' to be replaced by the output, got %v", schedule.ContextTemplates)
+	}
+
+	err = startScheduledRun(schedule, Trigger{FireTime: fireTime.Add(24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("Launch failed. err=%s", err)
+	}
+	run = runningTestRun(t, "s1")
+	wf, _ = conductor.GetWorkflow(run.WorkflowID)
+	if wf.Input["day"] != "fixed" || wf.Input["lastDate"] != "{{.Now}}" {
+		t.Errorf("Expected outputs passed without rendering, got %v", wf.Input)
+	}
+	window, _ := wf.Input["window"].(map[string]interface{})
+	if window["to"] != "2019-01-03" {
+		t.Errorf("Expected schedule templates to keep being rendered, got %v", wf.Input["window"])
+	}
+}
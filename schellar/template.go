@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Trigger describes what caused a workflow launch
+type Trigger struct {
+	FireTime     time.Time
+	RetryOf      string
+	RetryAttempt int
+}
+
+//templateData values available to schedule templates
+type templateData struct {
+	ScheduleName string
+	WorkflowName string
+	//FireTime time the run was scheduled for
+	FireTime time.Time
+	//Now actual time of the launch
+	Now          time.Time
+	RetryOf      string
+	RetryAttempt int
+	//Input values sent to the target (workflowContext plus trigger metadata). Set only when rendering target requests
+	//and workflowContext templates (where it has the values before rendering)
+	Input map[string]interface{}
+	//PreviousRun and LastCompletedRun are nil if there is no such run. Set only when rendering workflowContext templates
+	PreviousRun      *Run
+	LastCompletedRun *Run
+}
+
+//templateFuncs functions available to schedule templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"formatTime": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"parseTime": func(layout string, value string) (time.Time, error) {
+		return time.Parse(layout, value)
+	},
+	"addTime": func(duration string, t time.Time) (time.Time, error) {
+		d, err := time.ParseDuration(duration)
+		return t.Add(d), err
+	},
+	"addDate": func(years int, months int, days int, t time.Time) time.Time {
+		return t.AddDate(years, months, days)
+	},
+	"truncateTime": truncateTime,
+}
+
+//truncateTime truncates a time to the start of its 'day', 'month' or 'year', or to a multiple of a duration like '1h'
+func truncateTime(unit string, t time.Time) (time.Time, error) {
+	switch unit {
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()), nil
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()), nil
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location()), nil
+	}
+	d, err := time.ParseDuration(unit)
+	if err != nil {
+		return t, fmt.Errorf("Unit must be 'day', 'month', 'year' or a duration. err=%s", err)
+	}
+	return t.Truncate(d), nil
+}
+
+func newTemplateData(schedule Schedule, trigger Trigger) templateData {
+	return templateData{
+		ScheduleName: schedule.Name,
+		WorkflowName: schedule.WorkflowName,
+		FireTime:     trigger.FireTime,
+		Now:          time.Now(),
+		RetryOf:      trigger.RetryOf,
+		RetryAttempt: trigger.RetryAttempt,
+	}
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+}
+
+//renderTemplate evaluates a Go text/template with the given data
+func renderTemplate(name string, text string, data templateData) (string, error) {
+	t, err := parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+//isTemplate returns whether a workflowContext value is a template evaluated at fire time
+func isTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+//walkContextTemplates replaces the templates found in a workflowContext value, including the ones in nested objects and
+//arrays, with the results of fn
+func walkContextTemplates(name string, value interface{}, fn func(name string, text string) (interface{}, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if !isTemplate(v) {
+			return v, nil
+		}
+		return fn(name, v)
+	case bson.M:
+		return walkContextTemplates(name, map[string]interface{}(v), fn)
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for k, e := range v {
+			r, err := walkContextTemplates(name+"."+k, e, fn)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = r
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, 0)
+		for i, e := range v {
+			r, err := walkContextTemplates(fmt.Sprintf("%s[%d]", name, i), e, fn)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, r)
+		}
+		return result, nil
+	}
+	return value, nil
+}
+
+//hasContextTemplates returns whether any workflowContext value is a template
+func hasContextTemplates(name string, value interface{}) bool {
+	found := false
+	walkContextTemplates(name, value, func(name string, text string) (interface{}, error) {
+		found = true
+		return text, nil
+	})
+	return found
+}
+
+//contextTemplates returns the workflowContext values that have templates. Returns nil if there are none
+func contextTemplates(context map[string]interface{}) map[string]interface{} {
+	var templates map[string]interface{}
+	for k, v := range context {
+		if !hasContextTemplates(k, v) {
+			continue
+		}
+		if templates == nil {
+			templates = make(map[string]interface{})
+		}
+		templates[k] = v
+	}
+	return templates
+}
+
+//validateContextTemplates checks that the templates in workflowContext values can be parsed
+func validateContextTemplates(context map[string]interface{}) error {
+	for k, v := range context {
+		_, err := walkContextTemplates(k, v, func(name string, text string) (interface{}, error) {
+			_, err := parseTemplate(name, text)
+			if err != nil {
+				return nil, fmt.Errorf("'workflowContext.%s' is not a valid template. err=%s", name, err)
+			}
+			return text, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//renderContextTemplates returns a copy of the input with the values of the given templates rendered
+func renderContextTemplates(input map[string]interface{}, templates map[string]interface{}, data templateData) (map[string]interface{}, error) {
+	data.Input = input
+	rendered := make(map[string]interface{})
+	for k, v := range input {
+		rendered[k] = v
+	}
+	for k, v := range templates {
+		r, err := walkContextTemplates(k, v, func(name string, text string) (interface{}, error) {
+			result, err := renderTemplate(name, text, data)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't render workflowContext.%s. err=%s", name, err)
+			}
+			return result, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		rendered[k] = r
+	}
+	return rendered, nil
+}
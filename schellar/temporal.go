@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/client"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const temporalTarget = "temporal"
+
+//TemporalTarget starts a Temporal workflow on each trigger
+type TemporalTarget struct {
+	//HostPort address of the Temporal frontend
+	HostPort  string `json:"hostPort" bson:"hostPort"`
+	Namespace string `json:"namespace,omitempty" bson:"namespace,omitempty"`
+	TaskQueue string `json:"taskQueue" bson:"taskQueue"`
+	//WorkflowType defaults to the schedule workflowName
+	WorkflowType string `json:"workflowType,omitempty" bson:"workflowType,omitempty"`
+	//ExecutionTimeoutSeconds maximum duration of the workflow, enforced by Temporal. Zero means unlimited
+	ExecutionTimeoutSeconds int `json:"executionTimeoutSeconds,omitempty" bson:"executionTimeoutSeconds,omitempty"`
+}
+
+//temporalStartRequest a workflow to be started in Temporal
+type temporalStartRequest struct {
+	WorkflowID       string
+	WorkflowType     string
+	TaskQueue        string
+	Input            map[string]interface{}
+	ExecutionTimeout time.Duration
+}
+
+//temporalClient operations schellar uses from Temporal
+type temporalClient interface {
+	StartWorkflow(request temporalStartRequest) (string, error)
+	//DescribeWorkflow gets the state of the latest run of a workflow, with Conductor statuses
+	DescribeWorkflow(workflowID string) (*Workflow, error)
+	TerminateWorkflow(workflowID string, reason string) error
+}
+
+var (
+	temporalClientsMutex sync.Mutex
+	temporalClients      = make(map[string]temporalClient)
+)
+
+//getTemporalClient returns the client for the Temporal server and namespace of the target, connecting on first use
+func getTemporalClient(target *TemporalTarget) (temporalClient, error) {
+	temporalClientsMutex.Lock()
+	defer temporalClientsMutex.Unlock()
+	key := fmt.Sprintf("%s|%s", target.HostPort, target.Namespace)
+	c, exists := temporalClients[key]
+	if exists {
+		return c, nil
+	}
+	sdkClient, err := client.Dial(client.Options{HostPort: target.HostPort, Namespace: target.Namespace, Logger: temporalLogger{}})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't connect to Temporal at %s. err=%s", target.HostPort, err)
+	}
+	c = &sdkTemporalClient{client: sdkClient}
+	temporalClients[key] = c
+	return c, nil
+}
+
+//temporalExecutor launches schedule runs as Temporal workflows. Runs are tracked by polling their status
+type temporalExecutor struct{}
+
+func (e temporalExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.Temporal
+	if target == nil || target.HostPort == "" {
+		return errors.New("'target.temporal.hostPort' is required")
+	}
+	if target.TaskQueue == "" {
+		return errors.New("'target.temporal.taskQueue' is required")
+	}
+	if target.Namespace == "" {
+		target.Namespace = "default"
+	}
+	if target.WorkflowType == "" {
+		target.WorkflowType = schedule.WorkflowName
+	}
+	if target.ExecutionTimeoutSeconds < 0 {
+		return errors.New("'target.temporal.executionTimeoutSeconds' must be positive")
+	}
+	return nil
+}
+
+func (e temporalExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.Temporal
+	c, err := getTemporalClient(target)
+	if err != nil {
+		return Run{}, nil, err
+	}
+	workflowID := fmt.Sprintf("schellar-%s-%s", schedule.Name, newRunID())
+	runID, err := c.StartWorkflow(temporalStartRequest{
+		WorkflowID:       workflowID,
+		WorkflowType:     target.WorkflowType,
+		TaskQueue:        target.TaskQueue,
+		Input:            input,
+		ExecutionTimeout: time.Duration(target.ExecutionTimeoutSeconds) * time.Second,
+	})
+	if err != nil {
+		return Run{}, nil, err
+	}
+	logrus.Infof("Schedule %s: Temporal workflow %s started. workflowId=%s", schedule.Name, target.WorkflowType, workflowID)
+	run := Run{
+		WorkflowID:   workflowID,
+		WorkflowName: target.WorkflowType,
+		Result: map[string]interface{}{
+			"runId":     runID,
+			"hostPort":  target.HostPort,
+			"namespace": target.Namespace,
+			"taskQueue": target.TaskQueue,
+		},
+	}
+	return run, nil, nil
+}
+
+func (e temporalExecutor) Status(run Run) (*Workflow, error) {
+	target, err := runTemporalTarget(run)
+	if err != nil {
+		return nil, err
+	}
+	c, err := getTemporalClient(target)
+	if err != nil {
+		return nil, err
+	}
+	return c.DescribeWorkflow(run.WorkflowID)
+}
+
+func (e temporalExecutor) Cancel(run Run, reason string) error {
+	target, err := runTemporalTarget(run)
+	if err != nil {
+		return err
+	}
+	c, err := getTemporalClient(target)
+	if err != nil {
+		return err
+	}
+	return c.TerminateWorkflow(run.WorkflowID, reason)
+}
+
+//runTemporalTarget the Temporal server and namespace where the run was started
+func runTemporalTarget(run Run) (*TemporalTarget, error) {
+	hostPort, _ := run.Result["hostPort"].(string)
+	namespace, _ := run.Result["namespace"].(string)
+	if hostPort == "" {
+		//runs recovered without their result use the current target of the schedule
+		sc := mongoSession.Copy()
+		defer sc.Close()
+		var schedule Schedule
+		err := sc.DB(dbName).C("schedules").Find(bson.M{"name": run.ScheduleName}).One(&schedule)
+		if err != nil || schedule.Target == nil || schedule.Target.Temporal == nil {
+			return nil, fmt.Errorf("Run %s doesn't have its Temporal server recorded", run.WorkflowID)
+		}
+		return schedule.Target.Temporal, nil
+	}
+	return &TemporalTarget{HostPort: hostPort, Namespace: namespace}, nil
+}
+
+//sdkTemporalClient temporalClient using the Temporal Go SDK
+type sdkTemporalClient struct {
+	client client.Client
+}
+
+func (c *sdkTemporalClient) StartWorkflow(request temporalStartRequest) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wr, err := c.client.ExecuteWorkflow(ctx, client.StartWorkflowOptions{
+		ID:                       request.WorkflowID,
+		TaskQueue:                request.TaskQueue,
+		WorkflowExecutionTimeout: request.ExecutionTimeout,
+	}, request.WorkflowType, request.Input)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't start Temporal workflow %s. err=%s", request.WorkflowType, err)
+	}
+	return wr.GetRunID(), nil
+}
+
+func (c *sdkTemporalClient) DescribeWorkflow(workflowID string) (*Workflow, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := c.client.DescribeWorkflowExecution(ctx, workflowID, "")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't describe Temporal workflow %s. err=%s", workflowID, err)
+	}
+	info := resp.GetWorkflowExecutionInfo()
+	wf := &Workflow{WorkflowID: workflowID, WorkflowType: info.GetType().GetName()}
+	if info.GetStartTime() != nil {
+		wf.StartTime = info.GetStartTime().UnixNano() / int64(time.Millisecond)
+	}
+	if info.GetCloseTime() != nil {
+		wf.EndTime = info.GetCloseTime().UnixNano() / int64(time.Millisecond)
+	}
+
+	wf.Status = temporalStatus(info.GetStatus())
+	if wf.Status == "RUNNING" {
+		return wf, nil
+	}
+
+	//the result holds the workflow output or why it didn't complete
+	var output map[string]interface{}
+	err = c.client.GetWorkflow(ctx, workflowID, "").Get(ctx, &output)
+	if err != nil && wf.Status != "COMPLETED" {
+		wf.ReasonForIncompletion = err.Error()
+	}
+	if err == nil {
+		wf.Output = output
+	}
+	return wf, nil
+}
+
+//temporalStatus maps Temporal workflow execution statuses to Conductor statuses
+func temporalStatus(status enumspb.WorkflowExecutionStatus) string {
+	switch status {
+	case enumspb.WORKFLOW_EXECUTION_STATUS_RUNNING, enumspb.WORKFLOW_EXECUTION_STATUS_CONTINUED_AS_NEW:
+		return "RUNNING"
+	case enumspb.WORKFLOW_EXECUTION_STATUS_COMPLETED:
+		return "COMPLETED"
+	case enumspb.WORKFLOW_EXECUTION_STATUS_CANCELED, enumspb.WORKFLOW_EXECUTION_STATUS_TERMINATED:
+		return "TERMINATED"
+	case enumspb.WORKFLOW_EXECUTION_STATUS_TIMED_OUT:
+		return "TIMED_OUT"
+	default:
+		return "FAILED"
+	}
+}
+
+func (c *sdkTemporalClient) TerminateWorkflow(workflowID string, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := c.client.TerminateWorkflow(ctx, workflowID, "", reason)
+	if err != nil {
+		return fmt.Errorf("Couldn't terminate Temporal workflow %s. err=%s", workflowID, err)
+	}
+	return nil
+}
+
+//temporalLogger sends Temporal SDK logs to logrus
+type temporalLogger struct{}
+
+func (l temporalLogger) fields(keyvals []interface{}) logrus.Fields {
+	fields := logrus.Fields{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprintf("%v", keyvals[i])] = keyvals[i+1]
+	}
+	return fields
+}
+
+func (l temporalLogger) Debug(msg string, keyvals ...interface{}) {
+	logrus.WithFields(l.fields(keyvals)).Debug(msg)
+}
+
+func (l temporalLogger) Info(msg string, keyvals ...interface{}) {
+	logrus.WithFields(l.fields(keyvals)).Debug(msg)
+}
+
+func (l temporalLogger) Warn(msg string, keyvals ...interface{}) {
+	logrus.WithFields(l.fields(keyvals)).Warn(msg)
+}
+
+func (l temporalLogger) Error(msg string, keyvals ...interface{}) {
+	logrus.WithFields(l.fields(keyvals)).Error(msg)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//fakeTemporalClient in-memory Temporal where workflows stay RUNNING until they are finished with FinishWorkflow
+type fakeTemporalClient struct {
+	mutex     sync.Mutex
+	workflows map[string]*Workflow
+}
+
+func newFakeTemporalClient() *fakeTemporalClient {
+	return &fakeTemporalClient{workflows: make(map[string]*Workflow)}
+}
+
+func (c *fakeTemporalClient) StartWorkflow(request temporalStartRequest) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, exists := c.workflows[request.WorkflowID]; exists {
+		return "", fmt.Errorf("Workflow %s already started", request.WorkflowID)
+	}
+	c.workflows[request.WorkflowID] = &Workflow{
+		WorkflowID:   request.WorkflowID,
+		WorkflowType: request.WorkflowType,
+		Status:       "RUNNING",
+		StartTime:    time.Now().UnixNano() / int64(time.Millisecond),
+		Input:        request.Input,
+	}
+	return newRunID(), nil
+}
+
+func (c *fakeTemporalClient) DescribeWorkflow(workflowID string) (*Workflow, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wf, exists := c.workflows[workflowID]
+	if !exists {
+		return nil, fmt.Errorf("Workflow %s not found", workflowID)
+	}
+	wfc := *wf
+	return &wfc, nil
+}
+
+func (c *fakeTemporalClient) TerminateWorkflow(workflowID string, reason string) error {
+	return c.FinishWorkflow(workflowID, "TERMINATED", nil)
+}
+
+//FinishWorkflow changes the status of a running workflow, as if it was executed by a worker
+func (c *fakeTemporalClient) FinishWorkflow(workflowID string, status string, output map[string]interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wf, exists := c.workflows[workflowID]
+	if !exists {
+		return fmt.Errorf("Workflow %s not found", workflowID)
+	}
+	if wf.Status == "RUNNING" {
+		wf.Status = status
+		wf.Output = output
+		wf.EndTime = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	return nil
+}
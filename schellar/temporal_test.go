@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	enumspb "go.temporal.io/api/enums/v1"
+)
+
+func TestTemporalStatus(t *testing.T) {
+	tests := map[enumspb.WorkflowExecutionStatus]string{
+		enumspb.WORKFLOW_EXECUTION_STATUS_RUNNING:          "RUNNING",
+		enumspb.WORKFLOW_EXECUTION_STATUS_CONTINUED_AS_NEW: "RUNNING",
+		enumspb.WORKFLOW_EXECUTION_STATUS_COMPLETED:        "COMPLETED",
+		enumspb.WORKFLOW_EXECUTION_STATUS_FAILED:           "FAILED",
+		enumspb.WORKFLOW_EXECUTION_STATUS_TERMINATED:       "TERMINATED",
+		enumspb.WORKFLOW_EXECUTION_STATUS_CANCELED:         "TERMINATED",
+		enumspb.WORKFLOW_EXECUTION_STATUS_TIMED_OUT:        "TIMED_OUT",
+	}
+	for status, expected := range tests {
+		if s := temporalStatus(status); s != expected {
+			t.Errorf("%s: expected %s, got %s", status, expected, s)
+		}
+	}
+}
+
+func TestTemporalLaunchAndStatus(t *testing.T) {
+	fake := newFakeTemporalClient()
+	temporalClientsMutex.Lock()
+	previous, existed := temporalClients["temporal:7233|default"]
+	temporalClients["temporal:7233|default"] = fake
+	temporalClientsMutex.Unlock()
+	t.Cleanup(func() {
+		temporalClientsMutex.Lock()
+		defer temporalClientsMutex.Unlock()
+		if existed {
+			temporalClients["temporal:7233|default"] = previous
+		} else {
+			delete(temporalClients, "temporal:7233|default")
+		}
+	})
+
+	schedule := Schedule{
+		Name:         "s1",
+		WorkflowName: "encode",
+		Target:       &Target{Type: temporalTarget, Temporal: &TemporalTarget{HostPort: "temporal:7233", TaskQueue: "jobs"}},
+	}
+	err := temporalExecutor{}.Validate(&schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, state, err := temporalExecutor{}.Launch(schedule, Trigger{FireTime: time.Now()}, map[string]interface{}{"lastDate": "2019-01-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != nil {
+		t.Fatalf("Expected Temporal runs to be tracked by status checks")
+	}
+	wf, err := temporalExecutor{}.Status(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wf.Status != "RUNNING" || wf.WorkflowType != "encode" || wf.Input["lastDate"] != "2019-01-01" {
+		t.Errorf("Unexpected workflow %+v", wf)
+	}
+
+	err = temporalExecutor{}.Cancel(run, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf, _ = temporalExecutor{}.Status(run)
+	if wf.Status != "TERMINATED" {
+		t.Errorf("Expected workflow TERMINATED, got %s", wf.Status)
+	}
+}
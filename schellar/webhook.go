@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const webhookTarget = "webhook"
+
+//defaultWebhookDeniedHosts loopback, link-local (cloud metadata endpoints) and unspecified addresses
+const defaultWebhookDeniedHosts = "localhost,127.0.0.0/8,::1/128,169.254.0.0/16,fe80::/10,0.0.0.0/8,::/128"
+
+var (
+	//webhookAllowedHosts if not empty, webhook targets can only call these hosts
+	webhookAllowedHosts []hostRule
+	//webhookDeniedHosts hosts that webhook targets can't call
+	webhookDeniedHosts, _ = parseHostRules(defaultWebhookDeniedHosts)
+)
+
+//hostRule matches a host by name ('api.example.com' or '*.example.com') or by IP range ('10.0.0.0/8')
+type hostRule struct {
+	name    string
+	network *net.IPNet
+}
+
+//WebhookTarget calls an HTTP endpoint on each trigger
+type WebhookTarget struct {
+	//URL Go template with the same values as 'body'
+	URL     string            `json:"url" bson:"url"`
+	Method  string            `json:"method,omitempty" bson:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+	//Body Go template with access to .Input, .ScheduleName, .WorkflowName, .FireTime, .Now, .RetryOf and .RetryAttempt.
+	//Defaults to the input as JSON
+	Body           string `json:"body,omitempty" bson:"body,omitempty"`
+	HMACSecret     string `json:"hmacSecret,omitempty" bson:"hmacSecret,omitempty"`
+	HMACHeader     string `json:"hmacHeader,omitempty" bson:"hmacHeader,omitempty"`
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+	//SuccessStatusCodes response status codes considered successful. Defaults to any 2xx
+	SuccessStatusCodes []int `json:"successStatusCodes,omitempty" bson:"successStatusCodes,omitempty"`
+	//SuccessMatch JSON response fields (dot separated paths) and the values they must have for the call to be successful
+	SuccessMatch map[string]interface{} `json:"successMatch,omitempty" bson:"successMatch,omitempty"`
+}
+
+//webhookExecutor calls HTTP endpoints. Runs finish synchronously with the response
+type webhookExecutor struct{}
+
+func (e webhookExecutor) Validate(schedule *Schedule) error {
+	target := schedule.Target.Webhook
+	if target == nil || target.URL == "" {
+		return errors.New("'target.webhook.url' is required")
+	}
+	if _, err := parseTemplate("url", target.URL); err != nil {
+		return fmt.Errorf("'target.webhook.url' is not a valid template. err=%s", err)
+	}
+	if target.Body != "" {
+		if _, err := parseTemplate("body", target.Body); err != nil {
+			return fmt.Errorf("'target.webhook.body' is not a valid template. err=%s", err)
+		}
+	}
+	if target.Method == "" {
+		target.Method = "POST"
+	}
+	target.Method = strings.ToUpper(target.Method)
+	if target.TimeoutSeconds < 0 {
+		return errors.New("'target.webhook.timeoutSeconds' must be positive")
+	}
+	if target.TimeoutSeconds == 0 {
+		target.TimeoutSeconds = 30
+	}
+	if target.HMACSecret != "" && target.HMACHeader == "" {
+		target.HMACHeader = "X-Schellar-Signature"
+	}
+	for _, code := range target.SuccessStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("'target.webhook.successStatusCodes' has invalid status code %d", code)
+		}
+	}
+
+	//urls depending on the fire time or retries are checked again on launch
+	data := newTemplateData(*schedule, Trigger{FireTime: time.Now()})
+	data.Input = schedule.WorkflowContext
+	if url0, err := renderTemplate("url", target.URL, data); err == nil {
+		if err := checkWebhookURL(url0); err != nil {
+			return fmt.Errorf("'target.webhook.url' is not allowed. err=%s", err)
+		}
+	}
+	return nil
+}
+
+func (e webhookExecutor) Launch(schedule Schedule, trigger Trigger, input map[string]interface{}) (Run, *Workflow, error) {
+	target := schedule.Target.Webhook
+	data := newTemplateData(schedule, trigger)
+	data.Input = input
+
+	url0, err := renderTemplate("url", target.URL, data)
+	if err != nil {
+		return Run{}, nil, fmt.Errorf("Couldn't render webhook url. err=%s", err)
+	}
+	err = checkWebhookURL(url0)
+	if err != nil {
+		return Run{}, nil, fmt.Errorf("Webhook url is not allowed. err=%s", err)
+	}
+	var body []byte
+	if target.Body != "" {
+		b, err := renderTemplate("body", target.Body, data)
+		if err != nil {
+			return Run{}, nil, fmt.Errorf("Couldn't render webhook body. err=%s", err)
+		}
+		body = []byte(b)
+	} else if target.Method != "GET" && target.Method != "HEAD" {
+		body, err = json.Marshal(input)
+		if err != nil {
+			return Run{}, nil, err
+		}
+	}
+
+	req, err := http.NewRequest(target.Method, url0, bytes.NewReader(body))
+	if err != nil {
+		return Run{}, nil, fmt.Errorf("Invalid webhook request. err=%s", err)
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range target.Headers {
+		req.Header.Set(k, v)
+	}
+	if target.HMACSecret != "" {
+		mac := hmac.New(sha256.New, []byte(target.HMACSecret))
+		mac.Write(body)
+		req.Header.Set(target.HMACHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	startTime := time.Now()
+	client := newWebhookHTTPClient(time.Duration(target.TimeoutSeconds) * time.Second)
+	resp, datar, err := doHTTP(client, req)
+	endTime := time.Now()
+	state := &Workflow{
+		StartTime: startTime.UnixNano() / int64(time.Millisecond),
+		EndTime:   endTime.UnixNano() / int64(time.Millisecond),
+	}
+	run := Run{WorkflowID: newRunID()}
+	if err != nil {
+		//the call was made. Its failure is the result of the run, so that retry policies apply
+		logrus.Infof("Schedule %s: Webhook %s %s failed. err=%s", schedule.Name, target.Method, url0, err)
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = err.Error()
+		run.Result = map[string]interface{}{"error": err.Error()}
+		return run, state, nil
+	}
+	logrus.Infof("Schedule %s: Webhook %s %s called. status=%d", schedule.Name, target.Method, url0, resp.StatusCode)
+
+	var response interface{}
+	jsonErr := json.Unmarshal(datar, &response)
+	recordedBody := interface{}(truncate(string(datar), maxRecordedBytes))
+	if jsonErr == nil && len(datar) <= maxRecordedBytes {
+		recordedBody = response
+	}
+	run.Result = map[string]interface{}{
+		"statusCode":      resp.StatusCode,
+		"body":            recordedBody,
+		"durationSeconds": endTime.Sub(startTime).Seconds(),
+	}
+
+	reason := webhookFailure(target, resp.StatusCode, response, jsonErr)
+	if reason != "" {
+		state.Status = "FAILED"
+		state.ReasonForIncompletion = reason
+		return run, state, nil
+	}
+	state.Status = "COMPLETED"
+	if output, ok := response.(map[string]interface{}); ok {
+		state.Output = output
+	}
+	return run, state, nil
+}
+
+func (e webhookExecutor) Status(run Run) (*Workflow, error) {
+	return lostRunState(run), nil
+}
+
+func (e webhookExecutor) Cancel(run Run, reason string) error {
+	return fmt.Errorf("Webhook calls can't be cancelled")
+}
+
+//parseHostRules parses a comma separated list of host names, '*.domain' wildcards and CIDRs
+func parseHostRules(list string) ([]hostRule, error) {
+	rules := make([]hostRule, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CIDR '%s'. err=%s", item, err)
+			}
+			rules = append(rules, hostRule{network: network})
+			continue
+		}
+		if ip := net.ParseIP(item); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			rules = append(rules, hostRule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+			continue
+		}
+		rules = append(rules, hostRule{name: item})
+	}
+	return rules, nil
+}
+
+//matches tells whether the rule matches a host name or IP
+func (r hostRule) matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	if strings.HasPrefix(r.name, "*.") {
+		return strings.HasSuffix(host, r.name[1:])
+	}
+	return host == r.name
+}
+
+func matchesHostRules(rules []hostRule, host string) bool {
+	for _, r := range rules {
+		if r.matches(host) {
+			return true
+		}
+	}
+	return false
+}
+
+//checkWebhookHost checks a host against the allowed and denied hosts of webhook targets
+func checkWebhookHost(host string) error {
+	if matchesHostRules(webhookDeniedHosts, host) {
+		return fmt.Errorf("Host '%s' is denied", host)
+	}
+	if len(webhookAllowedHosts) > 0 && !matchesHostRules(webhookAllowedHosts, host) {
+		return fmt.Errorf("Host '%s' is not in the allowed hosts", host)
+	}
+	return nil
+}
+
+//checkWebhookURL checks that an url is an http(s) url to an allowed host
+func checkWebhookURL(url0 string) error {
+	u, err := url.Parse(url0)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Scheme must be http or https")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("Host is required")
+	}
+	return checkWebhookHost(u.Hostname())
+}
+
+//newWebhookHTTPClient creates an HTTP client that checks redirects against the allowed hosts and
+//refuses to connect to denied IPs, so that host names resolving to internal addresses are denied too
+func newWebhookHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if matchesHostRules(webhookDeniedHosts, host) {
+				return fmt.Errorf("Address '%s' is denied", host)
+			}
+			return nil
+		},
+	}
+	//proxies are not used, as they would connect to the denied addresses on our behalf
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("Too many redirects")
+			}
+			return checkWebhookURL(req.URL.String())
+		},
+	}
+}
+
+//webhookFailure checks the response against the success criteria of the target. Returns why it failed, or empty if successful
+func webhookFailure(target *WebhookTarget, statusCode int, response interface{}, jsonErr error) string {
+	if len(target.SuccessStatusCodes) > 0 {
+		found := false
+		for _, code := range target.SuccessStatusCodes {
+			if code == statusCode {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Sprintf("Unexpected response status %d", statusCode)
+		}
+	} else if statusCode < 200 || statusCode > 299 {
+		return fmt.Sprintf("Unexpected response status %d", statusCode)
+	}
+
+	if len(target.SuccessMatch) == 0 {
+		return ""
+	}
+	if jsonErr != nil {
+		return fmt.Sprintf("Response is not JSON. err=%s", jsonErr)
+	}
+	for path, expected := range target.SuccessMatch {
+		value, exists := jsonField(response, path)
+		if !exists {
+			return fmt.Sprintf("Response field '%s' not found", path)
+		}
+		if fmt.Sprintf("%v", value) != fmt.Sprintf("%v", expected) {
+			return fmt.Sprintf("Response field '%s' is '%v', expected '%v'", path, value, expected)
+		}
+	}
+	return ""
+}
+
+//jsonField gets a field of a decoded JSON value by a dot separated path
+func jsonField(value interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+//truncate limits a string to max bytes
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "...(truncated)"
+}
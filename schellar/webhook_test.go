@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func setWebhookHosts(t *testing.T, allowed string, denied string) {
+	var err error
+	webhookAllowedHosts, err = parseHostRules(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhookDeniedHosts, err = parseHostRules(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	defer setWebhookHosts(t, "", defaultWebhookDeniedHosts)
+	setWebhookHosts(t, "", defaultWebhookDeniedHosts)
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://example.com/jobs", true},
+		{"https://10.1.2.3:8443/jobs", true},
+		{"http://localhost:3000/schedule", false},
+		{"http://LOCALHOST./schedule", false},
+		{"http://127.0.0.1:27017", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[::1]:8080/", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, test := range tests {
+		err := checkWebhookURL(test.url)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: expected allowed=%t, got err=%v", test.url, test.allowed, err)
+		}
+	}
+
+	setWebhookHosts(t, "*.example.com,10.1.0.0/16", defaultWebhookDeniedHosts)
+	if checkWebhookURL("http://api.example.com/jobs") != nil || checkWebhookURL("http://10.1.2.3/jobs") != nil {
+		t.Errorf("Expected allowed hosts to be accepted")
+	}
+	if checkWebhookURL("http://example.org/jobs") == nil || checkWebhookURL("http://10.2.0.1/jobs") == nil {
+		t.Errorf("Expected hosts out of the allowed list to be denied")
+	}
+
+	_, err := parseHostRules("10.0.0.0/33")
+	if err == nil {
+		t.Errorf("Expected invalid CIDR to be rejected")
+	}
+}
+
+func TestWebhookValidateDeniedHost(t *testing.T) {
+	defer setWebhookHosts(t, "", defaultWebhookDeniedHosts)
+	setWebhookHosts(t, "", defaultWebhookDeniedHosts)
+	schedule := Schedule{
+		Name:            "s1",
+		WorkflowContext: map[string]interface{}{"host": "169.254.169.254"},
+		Target:          &Target{Type: webhookTarget, Webhook: &WebhookTarget{URL: "http://{{.Input.host}}/latest/meta-data"}},
+	}
+	err := webhookExecutor{}.Validate(&schedule)
+	if err == nil {
+		t.Errorf("Expected url to a denied host to be invalid")
+	}
+}
+
+func TestWebhookDialDeniedAddress(t *testing.T) {
+	defer setWebhookHosts(t, "", defaultWebhookDeniedHosts)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"lastDate": "2019-01-15"}`))
+	}))
+	defer server.Close()
+	schedule := Schedule{
+		Name:   "s1",
+		Target: &Target{Type: webhookTarget, Webhook: &WebhookTarget{URL: server.URL}},
+	}
+
+	//the server is on a loopback address
+	setWebhookHosts(t, "", "")
+	err := webhookExecutor{}.Validate(&schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, state, err := webhookExecutor{}.Launch(schedule, Trigger{FireTime: time.Now()}, map[string]interface{}{})
+	if err != nil || state.Status != "COMPLETED" || state.Output["lastDate"] != "2019-01-15" {
+		t.Fatalf("Expected call to succeed, got %v %v", state, err)
+	}
+
+	//names resolving to denied addresses can't be called either
+	setWebhookHosts(t, "", "127.0.0.0/8")
+	client := newWebhookHTTPClient(time.Second)
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, _, err = doHTTP(client, req)
+	if err == nil {
+		t.Errorf("Expected connection to a denied address to fail")
+	}
+}
@@ -5,9 +5,42 @@ set -x
 echo "Starting Schellar..."
 schellar \
     --conductor-api-url="$CONDUCTOR_API_URL" \
+    --conductors-config="$CONDUCTORS_CONFIG" \
+    --conductor-auth-token="$CONDUCTOR_AUTH_TOKEN" \
+    --conductor-username="$CONDUCTOR_USERNAME" \
+    --conductor-password="$CONDUCTOR_PASSWORD" \
+    --conductor-headers="$CONDUCTOR_HEADERS" \
+    --conductor-oauth2-token-url="$CONDUCTOR_OAUTH2_TOKEN_URL" \
+    --conductor-oauth2-client-id="$CONDUCTOR_OAUTH2_CLIENT_ID" \
+    --conductor-oauth2-client-secret="$CONDUCTOR_OAUTH2_CLIENT_SECRET" \
+    --conductor-oauth2-scopes="$CONDUCTOR_OAUTH2_SCOPES" \
+    --conductor-key-id="$CONDUCTOR_KEY_ID" \
+    --conductor-key-secret="$CONDUCTOR_KEY_SECRET" \
+    --conductor-timeout="$CONDUCTOR_TIMEOUT" \
+    --conductor-max-retries="$CONDUCTOR_MAX_RETRIES" \
+    --conductor-breaker-failures="$CONDUCTOR_BREAKER_FAILURES" \
+    --conductor-breaker-open-seconds="$CONDUCTOR_BREAKER_OPEN_SECONDS" \
+    --conductor-ca-file="$CONDUCTOR_CA_FILE" \
+    --conductor-cert-file="$CONDUCTOR_CERT_FILE" \
+    --conductor-key-file="$CONDUCTOR_KEY_FILE" \
+    --conductor-insecure-skip-verify="$CONDUCTOR_INSECURE_SKIP_VERIFY" \
     --check-interval="$CHECK_INTERVAL" \
     --mongo-address="$MONGO_ADDRESS" \
     --mongo-username=$MONGO_USERNAME \
     --mongo-password=$MONGO_PASSWORD \
+    --validate-workflows="$VALIDATE_WORKFLOWS" \
+    --max-concurrent-launches="$MAX_CONCURRENT_LAUNCHES" \
+    --workflow-rate-limits="$WORKFLOW_RATE_LIMITS" \
+    --conductor-rate-limit="$CONDUCTOR_RATE_LIMIT" \
+    --throttle-policy="$THROTTLE_POLICY" \
+    --outbox-max-attempts="$OUTBOX_MAX_ATTEMPTS" \
+    --callback-token="$CALLBACK_TOKEN" \
+    --notification-webhook-url="$NOTIFICATION_WEBHOOK_URL" \
+    --webhook-allowed-hosts="$WEBHOOK_ALLOWED_HOSTS" \
+    --webhook-denied-hosts="$WEBHOOK_DENIED_HOSTS" \
+    --command-target-enabled="$COMMAND_TARGET_ENABLED" \
+    --command-allowed-executables="$COMMAND_ALLOWED_EXECUTABLES" \
+    --command-dir-root="$COMMAND_DIR_ROOT" \
+    --grpc-descriptor-dir="$GRPC_DESCRIPTOR_DIR" \
     --loglevel=$LOG_LEVEL
 